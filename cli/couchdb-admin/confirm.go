@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cabify/couchdb-admin"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// confirm prints the impact of an operation and asks the operator to type its
+// target before going on, unless --yes was given.
+func confirm(c *cli.Context, impact *couchdb_admin.Impact) error {
+	printImpact(impact)
+	if c.GlobalBool("yes") {
+		return nil
+	}
+
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("Refusing to run %s without confirmation, use --yes!", impact.Command)
+	}
+	fmt.Fprintf(os.Stderr, "Type %s to confirm: ", impact.Target)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(answer) != impact.Target {
+		return fmt.Errorf("Confirmation does not match, aborting!")
+	}
+	return nil
+}
+
+func printImpact(impact *couchdb_admin.Impact) {
+	if impact.IsEmpty() {
+		fmt.Printf("%s %s does not affect any database\n", impact.Command, impact.Target)
+		return
+	}
+
+	if len(impact.Databases) > 0 {
+		fmt.Printf("%s %s affects %d database(s):\n", impact.Command, impact.Target, len(impact.Databases))
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "DB\tRANGE\tREPLICAS\tDB MIN REPLICAS")
+		for _, db := range impact.Databases {
+			for _, r := range db.Ranges {
+				fmt.Fprintf(w, "%s\t%s\t%d -> %d\t%d\n", db.Db, r.Range, r.ReplicasBefore, r.ReplicasAfter, db.MinReplicas)
+			}
+		}
+		w.Flush()
+	}
+
+	if len(impact.Changes) > 0 {
+		fmt.Printf("%s %s will:\n", impact.Command, impact.Target)
+		for _, change := range impact.Changes {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type profile struct {
+	Server       string `yaml:"server"`
+	Admin        string `yaml:"admin"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type configFile struct {
+	DefaultProfile string             `yaml:"default_profile"`
+	Profiles       map[string]profile `yaml:"profiles"`
+}
+
+type credentials struct {
+	server, admin, password string
+}
+
+var (
+	credentialsOnce sync.Once
+	clusterCreds    credentials
+)
+
+// clusterCredentials resolves the server and credentials to use the first
+// time they are needed. Flags take precedence over environment variables,
+// which take precedence over the selected profile.
+func clusterCredentials(c *cli.Context) credentials {
+	credentialsOnce.Do(func() {
+		var err error
+		if clusterCreds, err = loadCredentials(c); err != nil {
+			log.WithError(err).Fatal("Couldn't get the cluster's credentials!")
+		}
+	})
+	return clusterCreds
+}
+
+func loadCredentials(c *cli.Context) (credentials, error) {
+	p, err := loadProfile(c.GlobalString("config"), c.GlobalString("profile"))
+	if err != nil {
+		return credentials{}, err
+	}
+
+	creds := credentials{server: p.Server, admin: p.Admin, password: p.Password}
+	if isGlobalSet(c, "server") || creds.server == "" {
+		creds.server = c.GlobalString("server")
+	}
+	if isGlobalSet(c, "admin") {
+		creds.admin = c.GlobalString("admin")
+	}
+
+	passwordFile := p.PasswordFile
+	if isGlobalSet(c, "password") {
+		creds.password = c.GlobalString("password")
+	} else if isGlobalSet(c, "password-file") {
+		passwordFile = c.GlobalString("password-file")
+		creds.password = ""
+	}
+	if creds.password == "" && passwordFile != "" {
+		b, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return credentials{}, err
+		}
+		creds.password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	auth := c.GlobalString("auth")
+	if auth == "jwt" {
+		return creds, nil
+	}
+	if creds.admin == "" {
+		return credentials{}, fmt.Errorf("Missing admin!")
+	}
+	if auth != "proxy" && creds.password == "" {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return credentials{}, fmt.Errorf("Missing password for %s! Use --password-file, COUCHDB_ADMIN_PASSWORD or a profile", creds.admin)
+		}
+		if creds.password, err = readPassword(fmt.Sprintf("Password for %s@%s: ", creds.admin, creds.server)); err != nil {
+			return credentials{}, err
+		}
+	}
+	return creds, nil
+}
+
+// readPassword prompts for a password on the terminal without echoing it.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(b), err
+}
+
+// readNewPassword prompts twice for a password to set, or reads it from the
+// first line of stdin if it is not a terminal.
+func readNewPassword(name string) (string, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line == "" {
+			return "", fmt.Errorf("Missing password for %s on stdin!", name)
+		}
+		return line, nil
+	}
+
+	password, err := readPassword(fmt.Sprintf("New password for %s: ", name))
+	if err != nil {
+		return "", err
+	}
+	again, err := readPassword(fmt.Sprintf("Retype new password for %s: ", name))
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", fmt.Errorf("Passwords do not match!")
+	}
+	if password == "" {
+		return "", fmt.Errorf("Password cannot be empty!")
+	}
+	return password, nil
+}
+
+func loadProfile(path, name string) (profile, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && name == "" {
+		return profile{}, nil
+	} else if err != nil {
+		return profile{}, err
+	}
+
+	var config configFile
+	if err = yaml.Unmarshal(b, &config); err != nil {
+		return profile{}, fmt.Errorf("Couldn't parse %s: %s", path, err)
+	}
+
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	if name == "" {
+		return profile{}, nil
+	}
+
+	p, ok := config.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("Profile %s not found in %s", name, path)
+	}
+	return p, nil
+}
+
+// isGlobalSet tells whether a global flag was given either in the command
+// line or through its environment variable.
+func isGlobalSet(c *cli.Context, name string) bool {
+	if c.GlobalIsSet(name) {
+		return true
+	}
+	for _, flag := range c.App.Flags {
+		if f, ok := flag.(cli.StringFlag); ok && f.Name == name && f.EnvVar != "" {
+			for _, env := range strings.Split(f.EnvVar, ",") {
+				if os.Getenv(strings.TrimSpace(env)) != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
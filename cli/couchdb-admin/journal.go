@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cabify/couchdb-admin"
+)
+
+// failureTrackingJournal remembers whether any record could not be appended,
+// so that the tool exits non-zero even if the operation itself succeeded.
+type failureTrackingJournal struct {
+	couchdb_admin.Journal
+	failed bool
+}
+
+func (j *failureTrackingJournal) Append(ctx context.Context, rec *couchdb_admin.JournalRecord) error {
+	err := j.Journal.Append(ctx, rec)
+	if err != nil {
+		j.failed = true
+	}
+	return err
+}
+
+// Database forwards the name of the database the journal is kept in, if any,
+// so that it is still protected from deletion.
+func (j *failureTrackingJournal) Database() string {
+	if db, ok := j.Journal.(*couchdb_admin.DatabaseJournal); ok {
+		return db.Database()
+	}
+	return ""
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/cabify/couchdb-admin"
@@ -11,7 +21,15 @@ import (
 	"github.com/urfave/cli"
 )
 
+const minLockTTL = 3 * time.Second
+
 func main() {
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	cancelCommand := func() {}
+	defer func() { cancelCommand() }()
+	var journal *failureTrackingJournal
+
 	app := cli.NewApp()
 	app.Name = "CouchDB 2 Admin tool"
 	app.Usage = "Easily operate a CouchDB 2 cluster"
@@ -21,20 +39,189 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "server",
-			Usage: "The server to connect to",
-			Value: "127.0.0.1",
+			Name:   "server",
+			Usage:  "The server to connect to. Several comma separated servers can be given to fail over between them",
+			Value:  "127.0.0.1",
+			EnvVar: "COUCHDB_ADMIN_SERVER",
+		},
+		cli.BoolFlag{
+			Name:  "discover-servers",
+			Usage: "Fail over to any node of the cluster, not only the given servers",
+		},
+		cli.StringFlag{
+			Name:  "node-prefix",
+			Usage: "Name given to nodes identified only by their host, as in <prefix>@<host>",
+			Value: "couchdb",
+		},
+		cli.StringSliceFlag{
+			Name:   "node-host",
+			Usage:  "Host a node is reached at, as <node>=<host>, when it differs from the node's name (e.g. behind NAT). Can be repeated",
+			EnvVar: "COUCHDB_ADMIN_NODE_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "admin",
+			Usage:  "Admin of the DB",
+			EnvVar: "COUCHDB_ADMIN_USER",
+		},
+		cli.StringFlag{
+			Name:   "password",
+			Usage:  "Password for the db's admin. Prefer --password-file, the environment or a profile as flags are visible to other users",
+			EnvVar: "COUCHDB_ADMIN_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "password-file",
+			Usage:  "File holding the password for the db's admin",
+			EnvVar: "COUCHDB_ADMIN_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "Named cluster profile to take the server and credentials from",
+			EnvVar: "COUCHDB_ADMIN_PROFILE",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "File holding the cluster profiles",
+			Value: filepath.Join(os.Getenv("HOME"), ".couchdb-admin.yaml"),
+		},
+		cli.StringFlag{
+			Name:  "auth",
+			Usage: "Authentication mode: basic, cookie, jwt or proxy",
+			Value: "basic",
+		},
+		cli.StringFlag{
+			Name:  "jwt-file",
+			Usage: "File holding the JWT token for --auth=jwt",
+		},
+		cli.StringFlag{
+			Name:  "jwt-env",
+			Usage: "Environment variable holding the JWT token for --auth=jwt when --jwt-file is not given",
+			Value: "COUCHDB_JWT",
 		},
 		cli.StringFlag{
-			Name:  "admin",
-			Usage: "Admin of the DB",
-			Value: "admin",
+			Name:  "proxy-roles",
+			Usage: "Comma separated roles sent along with the admin's name for --auth=proxy",
+			Value: "_admin",
 		},
 		cli.StringFlag{
-			Name:  "password",
-			Usage: "Password for the db's admin",
-			Value: "password",
+			Name:  "proxy-secret",
+			Usage: "Secret used to sign the proxy authentication token for --auth=proxy",
 		},
+		cli.StringFlag{
+			Name:  "journal",
+			Usage: "File where to record every mutating operation",
+			Value: filepath.Join(os.Getenv("HOME"), ".couchdb-admin.journal"),
+		},
+		cli.StringFlag{
+			Name:  "journal-db",
+			Usage: "Database where to record every mutating operation (takes precedence over --journal)",
+		},
+		cli.StringFlag{
+			Name:  "operator",
+			Usage: "Name recorded in the journal and the cluster lock as the operation's author",
+			Value: os.Getenv("USER"),
+		},
+		cli.DurationFlag{
+			Name:  "lock-ttl",
+			Usage: "How long the cluster lock lasts if it is not renewed (at least 3s)",
+			Value: time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Maximum time to wait for each request to the cluster (0 to wait forever)",
+			Value: 10 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "command-timeout",
+			Usage: "Maximum time the whole command may take, including retries and waits (0 to wait forever)",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "Times a request is sent before giving up on transient failures (1 disables retries)",
+			Value: httpUtils.DefaultRetryPolicy.MaxAttempts,
+		},
+		cli.DurationFlag{
+			Name:  "retry-backoff",
+			Usage: "Time to wait before the first retry, doubled on each following one",
+			Value: httpUtils.DefaultRetryPolicy.InitialBackoff,
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Log every request sent to the cluster, including retries",
+		},
+		cli.IntFlag{
+			Name:  "min-replicas",
+			Usage: "Lowest number of replicas any shard may be left with. 0 requires a majority of the database's n",
+		},
+		cli.StringSliceFlag{
+			Name:  "db-min-replicas",
+			Usage: "Minimum replicas for a particular database, as <db>=<replicas>. Can be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "allow-under-replication",
+			Usage: "Let operations leave shards below the minimum replicas (but never without copies)",
+		},
+		cli.BoolFlag{
+			Name:  "require-zone-spread",
+			Usage: "Refuse, instead of warning about, changes leaving every copy of a shard in the same zone",
+		},
+		cli.BoolFlag{
+			Name:  "yes",
+			Usage: "Do not ask for confirmation before destructive operations",
+		},
+		cli.BoolFlag{
+			Name:  "force-unlock",
+			Usage: "Remove the cluster lock no matter who holds it before running the command",
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if c.GlobalBool("debug") {
+			log.SetLevel(log.DebugLevel)
+		}
+		if timeout := c.GlobalDuration("command-timeout"); timeout > 0 {
+			ctx, cancelCommand = context.WithTimeout(ctx, timeout)
+		}
+
+		switch c.GlobalString("auth") {
+		case "basic", "cookie", "jwt", "proxy":
+		default:
+			return fmt.Errorf("Unknown authentication mode %s!", c.GlobalString("auth"))
+		}
+		couchdb_admin.SetDefaultNodePrefix(c.GlobalString("node-prefix"))
+		if _, err := nodeHosts(c); err != nil {
+			return err
+		}
+
+		policy, err := replicaPolicy(c)
+		if err != nil {
+			return err
+		}
+		if policy.AllowUnderReplication {
+			log.Warn("Shards are allowed to be left under-replicated!")
+		}
+		couchdb_admin.SetReplicaPolicy(policy)
+
+		if db := c.GlobalString("journal-db"); db != "" {
+			journal = &failureTrackingJournal{Journal: couchdb_admin.NewDatabaseJournal(db, buildAuthHttpReq(ctx, c))}
+		} else if file := c.GlobalString("journal"); file != "" {
+			journal = &failureTrackingJournal{Journal: couchdb_admin.NewFileJournal(file)}
+		}
+		if journal != nil {
+			couchdb_admin.SetJournal(journal, c.GlobalString("operator"))
+		}
+
+		// The lease is renewed every third of its TTL, which must leave room
+		// for the renewal request itself.
+		if ttl := c.GlobalDuration("lock-ttl"); ttl < minLockTTL {
+			return fmt.Errorf("--lock-ttl must be at least %s!", minLockTTL)
+		}
+		host, _ := os.Hostname()
+		couchdb_admin.SetLockHolder(fmt.Sprintf("%s@%s:%d", c.GlobalString("operator"), host, os.Getpid()), c.GlobalDuration("lock-ttl"))
+		if c.GlobalBool("force-unlock") {
+			log.Warn("Forcing cluster unlock...")
+			return couchdb_admin.ForceUnlock(ctx, buildAuthHttpReq(ctx, c))
+		}
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -44,12 +231,26 @@ func main() {
 			Action: func(c *cli.Context) {
 				db_name := c.String("db")
 				log.WithField("db", db_name).Info("Describing database...")
-				db, err := couchdb_admin.LoadDB(db_name, buildAuthHttpReq(c))
+				db, err := couchdb_admin.LoadDB(ctx, db_name, buildAuthHttpReq(ctx, c))
 				if err != nil {
 					log.WithError(err).Error("Couldn't describe database!")
 					return
 				}
 				pretty.Println(db)
+
+				config := db.Config()
+				shards := make([]string, 0, len(config.ByRange))
+				for shard := range config.ByRange {
+					shards = append(shards, shard)
+				}
+				sort.Strings(shards)
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "Shard suffix: %s\n", config.Suffix())
+				fmt.Fprintln(w, "RANGE\tSHARD DB\tNODES")
+				for _, shard := range shards {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", shard, config.ShardDbName(shard), strings.Join(config.ByRange[shard], ","))
+				}
+				w.Flush()
 			},
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -61,6 +262,673 @@ func main() {
 				return requireFlags([]string{"db"}, c)
 			},
 		},
+		{
+			Name:  "shard_stats",
+			Usage: "Show the documents count and size of every copy of a database's shards",
+			Action: func(c *cli.Context) {
+				db_name := c.String("db")
+				ahr := buildAuthHttpReq(ctx, c)
+				db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+					return
+				}
+				stats, err := db.ShardStats(ctx, c.Float64("tolerance")/100, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't get shard stats!")
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "RANGE\tNODE\tDOCS\tDELETED\tFILE SIZE\tACTIVE SIZE\tUPDATE SEQ\t")
+				for _, copyStats := range stats {
+					if copyStats.Error != "" {
+						fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t%s\n", copyStats.Range, copyStats.Node, copyStats.Error)
+						continue
+					}
+					mark := ""
+					if copyStats.Diverges {
+						mark = "DIVERGES"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", copyStats.Range, copyStats.Node, copyStats.DocCount, copyStats.DocDelCount, copyStats.FileSize, copyStats.ActiveSize, copyStats.UpdateSeq, mark)
+				}
+				w.Flush()
+
+				for _, copyStats := range stats {
+					if copyStats.Diverges || copyStats.Error != "" {
+						log.WithFields(log.Fields{"db": db_name, "range": copyStats.Range, "node": copyStats.Node}).Warn("Shard copy diverges from its siblings!")
+					}
+				}
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Database on which to operate",
+				},
+				cli.Float64Flag{
+					Name:  "tolerance",
+					Usage: "Percentage of documents a copy may lack compared to the biggest copy of its range before being flagged",
+					Value: 5,
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"db"}, c)
+			},
+		},
+		{
+			Name:  "list_dbs",
+			Usage: "List databases with their documents count, size and sharding",
+			Action: func(c *cli.Context) {
+				filter, err := databaseFilter(c)
+				if err != nil {
+					log.WithError(err).Error("Invalid regular expression!")
+					return
+				}
+
+				infos, err := couchdb_admin.ListDatabases(ctx, filter, buildAuthHttpReq(ctx, c))
+				if err != nil {
+					log.WithError(err).Error("Couldn't list databases!")
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tDOCS\tDELETED\tFILE SIZE\tACTIVE SIZE\tQ\tN")
+				for _, info := range infos {
+					fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", info.Name, info.DocCount, info.DocDelCount, info.Sizes.File, info.Sizes.Active, info.Cluster.Q, info.Cluster.N)
+				}
+				w.Flush()
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "match",
+					Usage: "Only list databases whose name matches this glob, as in tenant_*",
+				},
+				cli.StringFlag{
+					Name:  "regex",
+					Usage: "Only list databases whose name matches this regular expression",
+				},
+				cli.BoolFlag{
+					Name:  "skip-system",
+					Usage: "Do not list system databases (those starting with _)",
+				},
+			},
+		},
+		{
+			Name:  "delete_db",
+			Usage: "Delete a database and all its data",
+			Action: func(c *cli.Context) {
+				db_name := c.String("db")
+				log.WithField("db", db_name).Info("Deleting database...")
+
+				ahr := buildAuthHttpReq(ctx, c)
+				impact, err := couchdb_admin.DeleteDatabaseImpact(ctx, db_name, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't compute the impact of deleting the database!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Database was not deleted")
+					return
+				}
+				if err = couchdb_admin.DeleteDatabase(ctx, db_name, c.Bool("force"), ahr); err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't delete database!")
+					return
+				}
+				log.WithField("db", db_name).Info("Database successfully deleted!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "The database to delete",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Delete the database even if it is a system one (_users, _replicator, _global_changes)",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if couchdb_admin.IsProtectedDatabase(c.String("db")) && !c.Bool("force") {
+					return fmt.Errorf("Refusing to delete system database %s without --force!", c.String("db"))
+				}
+				return requireFlags([]string{"db"}, c)
+			},
+		},
+		{
+			Name:  "get_security",
+			Usage: "Show a database's security object",
+			Action: func(c *cli.Context) {
+				db_name := c.String("db")
+				ahr := buildAuthHttpReq(ctx, c)
+				db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+					return
+				}
+				security, err := db.Security(ctx, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't get security!")
+					return
+				}
+				if security.IsPublic() {
+					log.WithField("db", db_name).Warn("Database is publicly readable!")
+				}
+				pretty.Println(security)
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Database on which to operate",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"db"}, c)
+			},
+		},
+		{
+			Name:  "set_security",
+			Usage: "Replace the security object of a database or of every database matching a pattern",
+			Action: func(c *cli.Context) {
+				security := &couchdb_admin.Security{
+					Admins: couchdb_admin.SecurityGroup{
+						Names: listFlag(c, "admins-names"),
+						Roles: listFlag(c, "admins-roles"),
+					},
+					Members: couchdb_admin.SecurityGroup{
+						Names: listFlag(c, "members-names"),
+						Roles: listFlag(c, "members-roles"),
+					},
+				}
+				if security.IsPublic() {
+					log.Warn("No members given, databases will be publicly readable!")
+				}
+
+				ahr := buildAuthHttpReq(ctx, c)
+				if db_name := c.String("db"); db_name != "" {
+					log.WithField("db", db_name).Info("Setting security...")
+					db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+					if err != nil {
+						log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+						return
+					}
+					if err = db.SetSecurity(ctx, security, ahr); err != nil {
+						log.WithField("db", db_name).WithError(err).Error("Couldn't set security!")
+						return
+					}
+					log.WithField("db", db_name).Info("Security successfully set!")
+					return
+				}
+
+				filter, err := databaseFilter(c)
+				if err != nil {
+					log.WithError(err).Error("Invalid regular expression!")
+					return
+				}
+				impact, err := couchdb_admin.SetSecurityMatchingImpact(ctx, filter, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't compute the impact of setting security!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Security was not set")
+					return
+				}
+
+				log.WithFields(log.Fields{"match": c.String("match"), "regex": c.String("regex")}).Info("Setting security...")
+				updated, err := couchdb_admin.SetSecurityMatching(ctx, filter, security, ahr)
+				if err != nil {
+					log.WithField("updated", updated).WithError(err).Error("Couldn't set security!")
+					return
+				}
+				log.WithField("dbs", len(updated)).Info("Security successfully set!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Database on which to operate",
+				},
+				cli.StringFlag{
+					Name:  "match",
+					Usage: "Operate on every database whose name matches this glob, as in tenant_*",
+				},
+				cli.StringFlag{
+					Name:  "regex",
+					Usage: "Operate on every database whose name matches this regular expression",
+				},
+				cli.BoolFlag{
+					Name:  "skip-system",
+					Usage: "Do not operate on system databases (those starting with _)",
+				},
+				cli.StringSliceFlag{
+					Name:  "admins-names",
+					Usage: "Users that administer the database. Comma separated or given several times",
+				},
+				cli.StringSliceFlag{
+					Name:  "admins-roles",
+					Usage: "Roles that administer the database. Comma separated or given several times",
+				},
+				cli.StringSliceFlag{
+					Name:  "members-names",
+					Usage: "Users that can read and write the database. Comma separated or given several times",
+				},
+				cli.StringSliceFlag{
+					Name:  "members-roles",
+					Usage: "Roles that can read and write the database. Comma separated or given several times",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if c.String("db") == "" && c.String("match") == "" && c.String("regex") == "" {
+					return fmt.Errorf("Missing db, match or regex parameter!")
+				}
+				if c.String("db") != "" && (c.String("match") != "" || c.String("regex") != "") {
+					return fmt.Errorf("db cannot be given along with match or regex!")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "audit_security",
+			Usage: "List the databases that are publicly readable",
+			Action: func(c *cli.Context) {
+				filter, err := databaseFilter(c)
+				if err != nil {
+					log.WithError(err).Error("Invalid regular expression!")
+					return
+				}
+
+				public, err := couchdb_admin.PublicDatabases(ctx, filter, buildAuthHttpReq(ctx, c))
+				if err != nil {
+					log.WithError(err).Error("Couldn't audit security!")
+					return
+				}
+				if len(public) == 0 {
+					log.Info("No database is publicly readable!")
+					return
+				}
+				for _, name := range public {
+					log.WithField("db", name).Warn("Database is publicly readable")
+				}
+				os.Exit(1)
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "match",
+					Usage: "Only audit databases whose name matches this glob, as in tenant_*",
+				},
+				cli.StringFlag{
+					Name:  "regex",
+					Usage: "Only audit databases whose name matches this regular expression",
+				},
+				cli.BoolFlag{
+					Name:  "skip-system",
+					Usage: "Do not audit system databases (those starting with _)",
+				},
+			},
+		},
+		{
+			Name:  "push_ddocs",
+			Usage: "Upload the design documents in a directory that differ from the database's",
+			Action: func(c *cli.Context) {
+				db_name, dir := c.String("db"), c.String("dir")
+				ddocs, err := couchdb_admin.LoadDesignDocs(dir)
+				if err != nil {
+					log.WithField("dir", dir).WithError(err).Error("Couldn't read design documents!")
+					return
+				}
+
+				log.WithFields(log.Fields{"db": db_name, "dir": dir, "ddocs": len(ddocs), "staged": c.Bool("staged")}).Info("Pushing design documents...")
+				opts := couchdb_admin.PushOptions{Staged: c.Bool("staged"), PollInterval: c.Duration("poll-interval")}
+				pushed, err := couchdb_admin.PushDesignDocs(ctx, db_name, ddocs, opts, buildAuthHttpReq(ctx, c))
+				if err != nil {
+					log.WithFields(log.Fields{"db": db_name, "pushed": pushed}).WithError(err).Error("Couldn't push design documents!")
+					return
+				}
+				log.WithFields(log.Fields{"db": db_name, "pushed": pushed}).Info("Design documents successfully pushed!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Database on which to operate",
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "Directory with the design documents, as <name>.json files or <name>/views/<view>/map.js directories",
+				},
+				cli.BoolFlag{
+					Name:  "staged",
+					Usage: "Upload changed design documents as _design/<name>_new and swap them once their views are built",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Usage: "How often to check indexing progress on staged deploys",
+					Value: 5 * time.Second,
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"db", "dir"}, c)
+			},
+		},
+		{
+			Name:  "index",
+			Usage: "Manage a database's Mango indexes",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List the indexes of a database",
+					Action: func(c *cli.Context) {
+						ahr := buildAuthHttpReq(ctx, c)
+						db, err := couchdb_admin.LoadDB(ctx, c.String("db"), ahr)
+						if err != nil {
+							log.WithField("db", c.String("db")).WithError(err).Error("Couldn't load database!")
+							return
+						}
+						indexes, err := db.Indexes(ctx, ahr)
+						if err != nil {
+							log.WithField("db", c.String("db")).WithError(err).Error("Couldn't list indexes!")
+							return
+						}
+
+						w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+						fmt.Fprintln(w, "DDOC\tNAME\tTYPE\tDEFINITION")
+						for _, index := range indexes {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", index.Ddoc, index.Name, index.Type, index.Def)
+						}
+						w.Flush()
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "db",
+							Usage: "Database on which to operate",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"db"}, c)
+					},
+				},
+				{
+					Name:      "create",
+					Usage:     "Create an index from its JSON definition, as POSTed to /{db}/_index",
+					ArgsUsage: "<definition>",
+					Action: func(c *cli.Context) {
+						db_name := c.String("db")
+						var def couchdb_admin.IndexDefinition
+						if err := json.Unmarshal([]byte(c.Args().First()), &def); err != nil {
+							log.WithError(err).Error("Invalid index definition!")
+							return
+						}
+
+						log.WithFields(log.Fields{"db": db_name, "name": def.Name}).Info("Creating index...")
+						ahr := buildAuthHttpReq(ctx, c)
+						db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+						if err != nil {
+							log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+							return
+						}
+						if err = db.CreateIndex(ctx, def, ahr); err != nil {
+							log.WithField("db", db_name).WithError(err).Error("Couldn't create index!")
+							return
+						}
+						log.WithFields(log.Fields{"db": db_name, "name": def.Name}).Info("Index successfully created!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "db",
+							Usage: "Database on which to operate",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return fmt.Errorf("Missing index definition!")
+						}
+						return requireFlags([]string{"db"}, c)
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "Delete an index",
+					Action: func(c *cli.Context) {
+						db_name, ddoc, name := c.String("db"), c.String("ddoc"), c.String("name")
+						log.WithFields(log.Fields{"db": db_name, "ddoc": ddoc, "name": name}).Info("Deleting index...")
+
+						ahr := buildAuthHttpReq(ctx, c)
+						db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+						if err != nil {
+							log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+							return
+						}
+						if err = db.DeleteIndex(ctx, ddoc, name, ahr); err != nil {
+							log.WithFields(log.Fields{"db": db_name, "ddoc": ddoc, "name": name}).WithError(err).Error("Couldn't delete index!")
+							return
+						}
+						log.WithFields(log.Fields{"db": db_name, "ddoc": ddoc, "name": name}).Info("Index successfully deleted!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "db",
+							Usage: "Database on which to operate",
+						},
+						cli.StringFlag{
+							Name:  "ddoc",
+							Usage: "The index's design document",
+						},
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "The index's name",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"db", "ddoc", "name"}, c)
+					},
+				},
+				{
+					Name:  "sync",
+					Usage: "Make a database's indexes match the ones declared in a file",
+					Action: func(c *cli.Context) {
+						db_name, file := c.String("db"), c.String("file")
+						f, err := os.Open(file)
+						if err != nil {
+							log.WithField("file", file).WithError(err).Error("Couldn't open indexes file!")
+							return
+						}
+						defer f.Close()
+						declared, err := couchdb_admin.LoadIndexDefinitions(f)
+						if err != nil {
+							log.WithField("file", file).WithError(err).Error("Couldn't read indexes file!")
+							return
+						}
+
+						log.WithFields(log.Fields{"db": db_name, "file": file, "prune": c.Bool("prune"), "dry-run": c.Bool("dry-run")}).Info("Syncing indexes...")
+						ahr := buildAuthHttpReq(ctx, c)
+						db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+						if err != nil {
+							log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+							return
+						}
+						if c.Bool("prune") && !c.Bool("dry-run") {
+							impact, err := db.SyncIndexesImpact(ctx, declared, ahr)
+							if err != nil {
+								log.WithField("db", db_name).WithError(err).Error("Couldn't compute the impact of syncing indexes!")
+								return
+							}
+							if err = confirm(c, impact); err != nil {
+								log.WithError(err).Error("Indexes were not synced")
+								return
+							}
+						}
+						report, err := db.SyncIndexes(ctx, declared, c.Bool("prune"), c.Bool("dry-run"), ahr)
+						if err != nil {
+							log.WithField("db", db_name).WithError(err).Error("Couldn't sync indexes!")
+							return
+						}
+
+						for _, def := range report.Created {
+							log.WithFields(log.Fields{"db": db_name, "ddoc": def.Ddoc, "name": def.Name, "index": string(def.Index)}).Info("Created index")
+						}
+						for _, index := range report.Deleted {
+							log.WithFields(log.Fields{"db": db_name, "index": index.String()}).Info("Deleted index")
+						}
+						if !c.Bool("prune") {
+							for _, index := range report.Unused {
+								log.WithFields(log.Fields{"db": db_name, "index": index.String()}).Warn("Index is not declared")
+							}
+						}
+						for _, duplicates := range report.Duplicates {
+							var names []string
+							for _, index := range duplicates {
+								names = append(names, index.String())
+							}
+							log.WithFields(log.Fields{"db": db_name, "indexes": names}).Warn("Indexes are duplicated")
+						}
+						log.WithField("db", db_name).Info("Indexes successfully synced!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "db",
+							Usage: "Database on which to operate",
+						},
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "JSON file with an array of index definitions",
+						},
+						cli.BoolFlag{
+							Name:  "prune",
+							Usage: "Delete the indexes that are not declared",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only report what would change",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"db", "file"}, c)
+					},
+				},
+			},
+		},
+		{
+			Name:  "compact_db",
+			Usage: "Compact a database's shards and optionally its views",
+			Action: func(c *cli.Context) {
+				db_name := c.String("db")
+				log.WithFields(log.Fields{"db": db_name, "views": c.Bool("views")}).Info("Triggering compaction...")
+
+				ahr := buildAuthHttpReq(ctx, c)
+				if err := couchdb_admin.CompactDatabase(ctx, db_name, c.Bool("views"), ahr); err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't trigger compaction!")
+					return
+				}
+				if !c.Bool("wait") {
+					log.WithField("db", db_name).Info("Compaction successfully triggered!")
+					return
+				}
+
+				if err := couchdb_admin.WaitForCompaction(ctx, db_name, c.Duration("poll-interval"), ahr); err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't wait for compaction!")
+					return
+				}
+				log.WithField("db", db_name).Info("Compaction successfully finished!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "The database to compact",
+				},
+				cli.BoolFlag{
+					Name:  "views",
+					Usage: "Compact the views of every design document too",
+				},
+				cli.BoolFlag{
+					Name:  "wait",
+					Usage: "Wait until every compaction of the database finishes",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Usage: "How often to check compaction progress when waiting",
+					Value: 5 * time.Second,
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"db"}, c)
+			},
+		},
+		{
+			Name:  "compaction_status",
+			Usage: "Show the progress of running compactions on every node",
+			Action: func(c *cli.Context) {
+				ahr := buildAuthHttpReq(ctx, c)
+				tasks, err := couchdb_admin.CompactionTasks(ctx, c.String("db"), ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't get compaction tasks!")
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NODE\tDB\tSHARD\tTYPE\tDESIGN DOC\tPHASE\tPROGRESS")
+				for _, task := range tasks {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d%%\n", task.Node, task.DbName(), task.Shard(), task.Type, task.DesignDocument, task.Phase, task.Progress)
+				}
+				w.Flush()
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Only show compactions of this database",
+				},
+			},
+		},
+		{
+			Name:  "active_tasks",
+			Usage: "Show the tasks running on every node, grouped by type and database",
+			Action: func(c *cli.Context) {
+				ahr := buildAuthHttpReq(ctx, c)
+				for {
+					tasks, err := couchdb_admin.ActiveTasks(ctx, ahr)
+					if err != nil {
+						log.WithError(err).Error("Couldn't get active tasks!")
+						return
+					}
+
+					var filtered []couchdb_admin.ActiveTask
+					for _, task := range tasks {
+						if (c.String("type") == "" || task.Type == c.String("type")) && (c.String("db") == "" || task.DbName() == c.String("db")) {
+							filtered = append(filtered, task)
+						}
+					}
+
+					watch := c.Duration("watch")
+					if watch > 0 && !c.Bool("json") {
+						fmt.Print("\033[H\033[2J")
+					}
+					printTasks(couchdb_admin.GroupTasks(filtered), c.Bool("json"))
+
+					if watch <= 0 {
+						return
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(watch):
+					}
+				}
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type",
+					Usage: "Only show tasks of this type (indexer, replication, database_compaction, view_compaction, ...)",
+				},
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Only show tasks on this database",
+				},
+				cli.DurationFlag{
+					Name:  "watch",
+					Usage: "Refresh the tasks with this period until interrupted",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output the tasks as JSON",
+				},
+			},
+		},
 		{
 			Name:  "replicate",
 			Usage: "Replicate a database's shard into a node not containing it already",
@@ -71,13 +939,13 @@ func main() {
 
 				log.WithFields(log.Fields{"db": db_name, "shard": shard, "replica": replica}).Info("Replicating shard...")
 
-				ahr := buildAuthHttpReq(c)
-				db, err := couchdb_admin.LoadDB(db_name, ahr)
+				ahr := buildAuthHttpReq(ctx, c)
+				db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
 				if err != nil {
 					log.WithError(err).WithField("db", db_name).Error("Couldn't load database")
 					return
 				}
-				if err = db.Replicate(shard, replica, ahr); err != nil {
+				if err = db.Replicate(ctx, shard, replica, ahr); err != nil {
 					log.WithError(err).WithFields(log.Fields{"db": db_name, "shard": shard, "replica": replica}).Error("Couldn't replicate shard!")
 					return
 				}
@@ -91,7 +959,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "replica",
-					Usage: "Node's address where to replicate the shard",
+					Usage: "Node's name (name@host) or host where to replicate the shard",
 				},
 				cli.StringFlag{
 					Name:  "db",
@@ -109,41 +977,90 @@ func main() {
 				node := c.String("node")
 				log.WithField("node", node).Info("Adding node to the cluster...")
 
-				ahr := buildAuthHttpReq(c)
-				cluster, err := couchdb_admin.LoadCluster(ahr)
+				ahr := buildAuthHttpReq(ctx, c)
+				cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Coulnd't load the cluster!")
+					return
+				}
+				if err = cluster.AddNode(ctx, node, ahr); err != nil {
+					log.WithField("node", node).WithError(err).Error("Couldn't add node!")
+					return
+				}
+				log.WithField("node", node).Info("Successfully added node!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "node",
+					Usage: "The node's name (name@host) or host",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"node"}, c)
+			},
+		},
+		{
+			Name:  "describe_cluster",
+			Usage: "Get information of the cluster's nodes",
+			Action: func(c *cli.Context) {
+				ahr := buildAuthHttpReq(ctx, c)
+				log.WithField("server", ahr.Server()).Info("Describing cluster layout...")
+				cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't describe cluster!")
+					return
+				}
+				pretty.Println(cluster.NodesInfo)
+
+				zones, err := couchdb_admin.NodeZones(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't get the nodes' zones!")
+					return
+				}
+				if len(zones) > 0 {
+					pretty.Println(zones)
+				}
+			},
+		},
+		{
+			Name:  "set_node_zone",
+			Usage: "Set the zone a node belongs to, used by zone-aware placement",
+			Action: func(c *cli.Context) {
+				node_name := c.String("node")
+				zone := c.String("zone")
+				log.WithFields(log.Fields{"node": node_name, "zone": zone}).Info("Setting node's zone...")
+
+				ahr := buildAuthHttpReq(ctx, c)
+				cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't load cluster!")
+					return
+				}
+				node, err := couchdb_admin.ParseNode(node_name)
 				if err != nil {
-					log.WithError(err).Error("Coulnd't load the cluster!")
+					log.WithField("node", node_name).WithError(err).Error("Couldn't locate node!")
 					return
 				}
-				if err = cluster.AddNode(node, ahr); err != nil {
-					log.WithField("node", node).WithError(err).Error("Couldn't add node!")
+				if err = cluster.SetNodeZone(ctx, node, zone, ahr); err != nil {
+					log.WithFields(log.Fields{"node": node_name, "zone": zone}).WithError(err).Error("Couldn't set node's zone!")
 					return
 				}
-				log.WithField("node", node).Info("Successfully added node!")
+				log.WithFields(log.Fields{"node": node_name, "zone": zone}).Info("Node's zone successfully set!")
 			},
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "node",
-					Usage: "Node's address",
+					Usage: "The node's name (name@host) or host",
+				},
+				cli.StringFlag{
+					Name:  "zone",
+					Usage: "The zone's name. Leave it empty to remove the node's zone",
 				},
 			},
 			Before: func(c *cli.Context) error {
 				return requireFlags([]string{"node"}, c)
 			},
 		},
-		{
-			Name:  "describe_cluster",
-			Usage: "Get information of the cluster's nodes",
-			Action: func(c *cli.Context) {
-				log.WithField("server", c.GlobalString("server")).Info("Describing cluster layout...")
-				cluster, err := couchdb_admin.LoadCluster(buildAuthHttpReq(c))
-				if err != nil {
-					log.WithError(err).Error("Couldn't describe cluster!")
-					return
-				}
-				pretty.Println(cluster.NodesInfo)
-			},
-		},
 		{
 			Name:  "create_db",
 			Usage: "Create a new database",
@@ -152,7 +1069,32 @@ func main() {
 				replicas, shards := c.Int("replicas"), c.Int("shards")
 				log.WithFields(log.Fields{"db": db, "replicas": replicas, "shards": shards}).Info("Creating database...")
 
-				if _, err := couchdb_admin.CreateDatabase(db, replicas, shards, buildAuthHttpReq(c)); err != nil {
+				ahr := buildAuthHttpReq(ctx, c)
+				var err error
+				switch {
+				case c.String("placement") != "":
+					_, err = couchdb_admin.CreateDatabaseWithPlacement(ctx, db, c.String("placement"), shards, ahr)
+				case c.String("nodes") != "":
+					nodes := strings.Split(c.String("nodes"), ",")
+					if !c.IsSet("replicas") {
+						replicas = len(nodes)
+					}
+					layout := couchdb_admin.LayoutOnNodes(nodes, shards, replicas)
+					_, err = couchdb_admin.CreateDatabaseWithLayout(ctx, db, layout, ahr)
+				case c.String("layout") != "":
+					var layout couchdb_admin.Layout
+					if layout, err = loadLayout(c.String("layout")); err == nil {
+						_, err = couchdb_admin.CreateDatabaseWithLayout(ctx, db, layout, ahr)
+					}
+				case c.String("like") != "":
+					var layout couchdb_admin.Layout
+					if layout, err = couchdb_admin.LayoutOf(ctx, c.String("like"), ahr); err == nil {
+						_, err = couchdb_admin.CreateDatabaseWithLayout(ctx, db, layout, ahr)
+					}
+				default:
+					_, err = couchdb_admin.CreateDatabase(ctx, db, replicas, shards, ahr)
+				}
+				if err != nil {
 					log.WithFields(log.Fields{"db": db, "replicas": replicas, "shards": shards}).WithError(err).Error("Could not create database!")
 					return
 				}
@@ -173,11 +1115,191 @@ func main() {
 					Usage: "Number of replicas for each shard",
 					Value: 3,
 				},
+				cli.StringFlag{
+					Name:  "placement",
+					Usage: "Spread replicas across zones, as in zoneA:2,zoneB:1. Takes precedence over --replicas",
+				},
+				cli.StringFlag{
+					Name:  "nodes",
+					Usage: "Comma separated nodes to spread the shards over, with --replicas copies each (every node holds every shard unless --replicas is given)",
+				},
+				cli.StringFlag{
+					Name:  "layout",
+					Usage: "JSON file with the nodes holding each range, as in the by_range section of a _dbs document",
+				},
+				cli.StringFlag{
+					Name:  "like",
+					Usage: "Existing database whose shard layout to copy",
+				},
 			},
 			Before: func(c *cli.Context) error {
+				set := 0
+				for _, flag := range []string{"placement", "nodes", "layout", "like"} {
+					if c.String(flag) != "" {
+						set++
+					}
+				}
+				if set > 1 {
+					return fmt.Errorf("Only one of --placement, --nodes, --layout and --like can be given!")
+				}
+				if nodes := c.String("nodes"); nodes != "" && c.IsSet("replicas") && c.Int("replicas") > len(strings.Split(nodes, ",")) {
+					return fmt.Errorf("Cannot place %d replicas on %d nodes!", c.Int("replicas"), len(strings.Split(nodes, ",")))
+				}
 				return requireFlags([]string{"db"}, c)
 			},
 		},
+		{
+			Name:  "split_shard",
+			Usage: "Split a database's shard in two on every node holding it (CouchDB 3+)",
+			Action: func(c *cli.Context) {
+				db_name, shardRange := c.String("db"), c.String("range")
+				log.WithFields(log.Fields{"db": db_name, "range": shardRange}).Info("Splitting shard...")
+
+				ahr := buildAuthHttpReq(ctx, c)
+				db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
+				if err != nil {
+					log.WithField("db", db_name).WithError(err).Error("Couldn't load database!")
+					return
+				}
+				if err = db.SplitShard(ctx, shardRange, c.Duration("poll-interval"), ahr); err != nil {
+					log.WithFields(log.Fields{"db": db_name, "range": shardRange}).WithError(err).Error("Couldn't split shard!")
+					return
+				}
+				log.WithFields(log.Fields{"db": db_name, "range": shardRange}).Info("Shard successfully split!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Database on which to operate",
+				},
+				cli.StringFlag{
+					Name:  "range",
+					Usage: "The shard range to split, as in 00000000-1fffffff",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Usage: "How often to check the split progress",
+					Value: 5 * time.Second,
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"db", "range"}, c)
+			},
+		},
+		{
+			Name:  "reshard_status",
+			Usage: "Show the state of resharding and its jobs",
+			Action: func(c *cli.Context) {
+				ahr := buildAuthHttpReq(ctx, c)
+				summary, err := couchdb_admin.ReshardStatus(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't get resharding status!")
+					return
+				}
+				log.WithFields(log.Fields{
+					"state":     summary.State,
+					"reason":    summary.StateReason,
+					"running":   summary.Running,
+					"stopped":   summary.Stopped,
+					"completed": summary.Completed,
+					"failed":    summary.Failed,
+				}).Info("Resharding status")
+
+				jobs, err := couchdb_admin.ListReshardJobs(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't list reshard jobs!")
+					return
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tDB\tNODE\tSOURCE\tSTATE\tSPLIT STATE\tPROGRESS\tREASON")
+				for _, job := range jobs {
+					if db := c.String("db"); db != "" && job.DbName() != db {
+						continue
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d%%\t%s\n", job.Id, job.DbName(), job.Node, job.Source, job.JobState, job.SplitState, job.Progress(), job.StateInfo.Reason)
+				}
+				w.Flush()
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Only show jobs of this database",
+				},
+			},
+		},
+		{
+			Name:  "reshard_job",
+			Usage: "Stop, resume or remove a reshard job",
+			Subcommands: []cli.Command{
+				{
+					Name:  "stop",
+					Usage: "Stop a running job",
+					Action: func(c *cli.Context) {
+						id := c.String("id")
+						if err := couchdb_admin.StopReshardJob(ctx, id, c.String("reason"), buildAuthHttpReq(ctx, c)); err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't stop job!")
+							return
+						}
+						log.WithField("id", id).Info("Job successfully stopped!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "The job's id",
+						},
+						cli.StringFlag{
+							Name:  "reason",
+							Usage: "Why the job is stopped",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"id"}, c)
+					},
+				},
+				{
+					Name:  "resume",
+					Usage: "Resume a stopped job",
+					Action: func(c *cli.Context) {
+						id := c.String("id")
+						if err := couchdb_admin.ResumeReshardJob(ctx, id, buildAuthHttpReq(ctx, c)); err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't resume job!")
+							return
+						}
+						log.WithField("id", id).Info("Job successfully resumed!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "The job's id",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"id"}, c)
+					},
+				},
+				{
+					Name:  "remove",
+					Usage: "Remove a job, stopping it if it is running",
+					Action: func(c *cli.Context) {
+						id := c.String("id")
+						if err := couchdb_admin.RemoveReshardJob(ctx, id, buildAuthHttpReq(ctx, c)); err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't remove job!")
+							return
+						}
+						log.WithField("id", id).Info("Job successfully removed!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "The job's id",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"id"}, c)
+					},
+				},
+			},
+		},
 		{
 			Name:  "remove_replica",
 			Usage: "Remove a shard from a particular node",
@@ -188,13 +1310,22 @@ func main() {
 
 				log.WithFields(log.Fields{"db": db_name, "shard": shard, "replica": replica}).Info("Removing shard ownership...")
 
-				ahr := buildAuthHttpReq(c)
-				db, err := couchdb_admin.LoadDB(db_name, ahr)
+				ahr := buildAuthHttpReq(ctx, c)
+				db, err := couchdb_admin.LoadDB(ctx, db_name, ahr)
 				if err != nil {
 					log.WithField("db", db_name).WithError(err).Error("Couldn't load db config!")
 					return
 				}
-				if err = db.RemoveReplica(shard, replica, ahr); err != nil {
+				impact, err := db.RemoveReplicaImpact(ctx, shard, replica, ahr)
+				if err != nil {
+					log.WithFields(log.Fields{"db": db_name, "shard": shard, "replica": replica}).WithError(err).Error("Couldn't compute the impact of removing the replica!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Replica was not removed")
+					return
+				}
+				if err = db.RemoveReplica(ctx, shard, replica, ahr); err != nil {
 					log.WithFields(log.Fields{"db": db_name, "shard": replica, "replica": replica}).WithError(err).Error("Replica could not be removed!")
 					return
 				}
@@ -211,7 +1342,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "from",
-					Usage: "Node's address from where to remove the shard's replica",
+					Usage: "Node's name (name@host) or host from where to remove the shard's replica",
 				},
 			},
 			Before: func(c *cli.Context) error {
@@ -225,13 +1356,13 @@ func main() {
 				node_name := c.String("node")
 				log.WithField("node", node_name).Info("Removing maintenance flag...")
 
-				ahr := buildAuthHttpReq(c)
-				node, err := couchdb_admin.NodeAt(node_name)
+				ahr := buildAuthHttpReq(ctx, c)
+				node, err := couchdb_admin.ParseNode(node_name)
 				if err != nil {
 					log.WithField("node", node_name).WithError(err).Error("Couldn't locate node!")
 					return
 				}
-				if err = node.DisableMaintenance(ahr); err != nil {
+				if err = node.DisableMaintenance(ctx, ahr); err != nil {
 					log.WithField("node", node_name).WithError(err).Error("Couldn't disable maintenance flag!")
 					return
 				}
@@ -240,7 +1371,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "node",
-					Usage: "The node's address",
+					Usage: "The node's name (name@host) or host",
 				},
 			},
 			Before: func(c *cli.Context) error {
@@ -257,18 +1388,21 @@ func main() {
 				value := c.String("value")
 				log.WithFields(log.Fields{"node": node_name, "section": section, "key": key, "value": value}).Info("Setting config value...")
 
-				node, err := couchdb_admin.NodeAt(node_name)
+				node, err := couchdb_admin.ParseNode(node_name)
 				if err != nil {
 					log.WithError(err).WithField("node", node_name).Error("Couldn't locate node!")
 					return
 				}
-				node.SetConfig(section, key, value, buildAuthHttpReq(c))
+				if err = node.SetConfig(ctx, section, key, value, buildAuthHttpReq(ctx, c)); err != nil {
+					log.WithFields(log.Fields{"node": node_name, "section": section, "key": key}).WithError(err).Error("Couldn't set config value!")
+					return
+				}
 				log.WithFields(log.Fields{"node": node_name, "section": section, "key": key, "value": value}).Info("New config successfully applied!")
 			},
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "node",
-					Usage: "The node's address",
+					Usage: "The node's name (name@host) or host",
 				},
 				cli.StringFlag{
 					Name:  "section",
@@ -294,18 +1428,27 @@ func main() {
 				node_name := c.String("node")
 				log.WithField("node", node_name).Info("Removing node...")
 
-				ahr := buildAuthHttpReq(c)
-				cluster, err := couchdb_admin.LoadCluster(ahr)
+				ahr := buildAuthHttpReq(ctx, c)
+				cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
 				if err != nil {
 					log.WithError(err).Error("Couldn't load cluster!")
 					return
 				}
-				node, err := couchdb_admin.NodeAt(node_name)
+				node, err := couchdb_admin.ParseNode(node_name)
 				if err != nil {
 					log.WithField("node", node_name).WithError(err).Error("Couldn't locate node!")
 					return
 				}
-				if err = cluster.RemoveNode(node, ahr); err != nil {
+				impact, err := cluster.RemoveNodeImpact(ctx, node, ahr)
+				if err != nil {
+					log.WithField("node", node_name).WithError(err).Error("Couldn't compute the impact of removing the node!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Node was not removed")
+					return
+				}
+				if err = cluster.RemoveNode(ctx, node, ahr); err != nil {
 					log.WithField("node", node_name).WithError(err).Error("Couldn't remove node!")
 					return
 				}
@@ -314,20 +1457,773 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "node",
-					Usage: "The node's address",
+					Usage: "The node's name (name@host) or host",
 				},
 			},
 			Before: func(c *cli.Context) error {
 				return requireFlags([]string{"node"}, c)
 			},
 		},
+		{
+			Name:  "snapshot_shard_maps",
+			Usage: "Save a point-in-time copy of every database's shards placement",
+			Action: func(c *cli.Context) {
+				out := c.String("out")
+				log.WithField("out", out).Info("Taking shard maps snapshot...")
+
+				snapshot, err := couchdb_admin.SnapshotShardMaps(ctx, buildAuthHttpReq(ctx, c))
+				if err != nil {
+					log.WithError(err).Error("Couldn't take shard maps snapshot!")
+					return
+				}
+
+				f, err := os.Create(out)
+				if err != nil {
+					log.WithField("out", out).WithError(err).Error("Couldn't create snapshot file!")
+					return
+				}
+				defer f.Close()
+
+				if err = snapshot.Save(f); err != nil {
+					log.WithField("out", out).WithError(err).Error("Couldn't write snapshot file!")
+					return
+				}
+				log.WithFields(log.Fields{"out": out, "dbs": len(snapshot.Databases)}).Info("Shard maps successfully saved!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "File where to save the snapshot",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"out"}, c)
+			},
+		},
+		{
+			Name:  "restore_shard_maps",
+			Usage: "Reapply the shards placement saved in a snapshot",
+			Action: func(c *cli.Context) {
+				in := c.String("in")
+				db_name := c.String("db")
+				log.WithFields(log.Fields{"in": in, "db": db_name}).Info("Restoring shard maps...")
+
+				f, err := os.Open(in)
+				if err != nil {
+					log.WithField("in", in).WithError(err).Error("Couldn't open snapshot file!")
+					return
+				}
+				defer f.Close()
+
+				snapshot, err := couchdb_admin.LoadShardMapSnapshot(f)
+				if err != nil {
+					log.WithField("in", in).WithError(err).Error("Couldn't read snapshot file!")
+					return
+				}
+				ahr := buildAuthHttpReq(ctx, c)
+				impact, err := snapshot.RestoreImpact(ctx, db_name, ahr)
+				if err != nil {
+					log.WithFields(log.Fields{"in": in, "db": db_name}).WithError(err).Error("Couldn't compute the impact of restoring shard maps!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Shard maps were not restored")
+					return
+				}
+
+				if err = snapshot.Restore(ctx, db_name, ahr); err != nil {
+					log.WithFields(log.Fields{"in": in, "db": db_name}).WithError(err).Error("Couldn't restore shard maps!")
+					return
+				}
+				log.WithFields(log.Fields{"in": in, "db": db_name}).Info("Shard maps successfully restored!")
+			},
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "in",
+					Usage: "Snapshot file to restore",
+				},
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "Restore only this database (all databases in the snapshot by default)",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				return requireFlags([]string{"in"}, c)
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "List the operations recorded in the journal",
+			Action: func(c *cli.Context) {
+				records, err := couchdb_admin.JournalRecords(ctx)
+				if err != nil {
+					log.WithError(err).Error("Couldn't read the journal!")
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tTIMESTAMP\tOPERATOR\tCOMMAND\tTARGET")
+				for _, rec := range records {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", rec.Id, rec.Timestamp.Format(time.RFC3339), rec.Operator, rec.Command, rec.Target)
+				}
+				w.Flush()
+			},
+		},
+		{
+			Name:      "undo",
+			Usage:     "Revert an operation recorded in the journal",
+			ArgsUsage: "<id>",
+			Action: func(c *cli.Context) {
+				id := c.Args().First()
+				impact, err := couchdb_admin.UndoImpact(ctx, id)
+				if err != nil {
+					log.WithField("id", id).WithError(err).Error("Couldn't find operation!")
+					return
+				}
+				if err = confirm(c, impact); err != nil {
+					log.WithError(err).Error("Operation was not undone")
+					return
+				}
+
+				log.WithField("id", id).Info("Undoing operation...")
+				if err = couchdb_admin.Undo(ctx, id, buildAuthHttpReq(ctx, c)); err != nil {
+					log.WithField("id", id).WithError(err).Error("Couldn't undo operation!")
+					return
+				}
+				log.WithField("id", id).Info("Operation successfully undone!")
+			},
+			Before: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("Missing operation id!")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "check_consistency",
+			Usage: "Check that every node has the same _nodes and _dbs documents",
+			Action: func(c *cli.Context) {
+				ahr := buildAuthHttpReq(ctx, c)
+				cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't describe cluster!")
+					return
+				}
+
+				log.Info("Checking node-local databases...")
+				inconsistencies, err := cluster.CheckConsistency(ctx, ahr)
+				if err != nil {
+					log.WithError(err).Error("Couldn't check consistency!")
+					return
+				}
+				if len(inconsistencies) == 0 {
+					log.Info("All nodes agree!")
+					return
+				}
+				for _, inconsistency := range inconsistencies {
+					log.WithFields(log.Fields{"db": inconsistency.Db, "id": inconsistency.Id}).Warn("Nodes disagree on document")
+					pretty.Println(inconsistency.Revs)
+				}
+				os.Exit(1)
+			},
+		},
+		{
+			Name:  "locks",
+			Usage: "List the locks taken on the cluster",
+			Action: func(c *cli.Context) {
+				leases, err := couchdb_admin.ListLocks(ctx, buildAuthHttpReq(ctx, c))
+				if err != nil {
+					log.WithError(err).Error("Couldn't list locks!")
+					return
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "LOCK\tHOLDER\tCOMMAND\tACQUIRED\tEXPIRES")
+				for _, lease := range leases {
+					expires := lease.ExpiresAt.Format(time.RFC3339)
+					if lease.Expired() {
+						expires += " (expired)"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", lease.Id, lease.Holder, lease.Command, lease.AcquiredAt.Format(time.RFC3339), expires)
+				}
+				w.Flush()
+			},
+		},
+		{
+			Name:  "user",
+			Usage: "Manage the users in _users and the server admins",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "Create a user, prompting for its password",
+					Action: func(c *cli.Context) {
+						name := c.String("name")
+						ahr := buildAuthHttpReq(ctx, c)
+						password, err := readNewPassword(name)
+						if err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't read password!")
+							return
+						}
+
+						if c.Bool("server-admin") {
+							log.WithField("name", name).Info("Adding server admin...")
+							cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+							if err != nil {
+								log.WithError(err).Error("Couldn't load cluster!")
+								return
+							}
+							if err = cluster.SetAdmin(ctx, name, password, ahr); err != nil {
+								log.WithField("name", name).WithError(err).Error("Couldn't add server admin!")
+								return
+							}
+							log.WithField("name", name).Info("Server admin successfully added!")
+							return
+						}
+
+						log.WithFields(log.Fields{"name": name, "roles": listFlag(c, "roles")}).Info("Adding user...")
+						if err = couchdb_admin.AddUser(ctx, name, password, listFlag(c, "roles"), ahr); err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't add user!")
+							return
+						}
+						log.WithField("name", name).Info("User successfully added!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "The user's name",
+						},
+						cli.StringSliceFlag{
+							Name:  "roles",
+							Usage: "The user's roles. Comma separated or given several times",
+						},
+						cli.BoolFlag{
+							Name:  "server-admin",
+							Usage: "Operate on the server admins of every node instead of _users",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						if c.Bool("server-admin") && len(c.StringSlice("roles")) > 0 {
+							return fmt.Errorf("Server admins do not have roles!")
+						}
+						return requireFlags([]string{"name"}, c)
+					},
+				},
+				{
+					Name:  "passwd",
+					Usage: "Change a user's password, prompting for it",
+					Action: func(c *cli.Context) {
+						name := c.String("name")
+						ahr := buildAuthHttpReq(ctx, c)
+						password, err := readNewPassword(name)
+						if err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't read password!")
+							return
+						}
+
+						log.WithFields(log.Fields{"name": name, "server-admin": c.Bool("server-admin")}).Info("Changing password...")
+						if c.Bool("server-admin") {
+							cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+							if err != nil {
+								log.WithError(err).Error("Couldn't load cluster!")
+								return
+							}
+							err = cluster.SetAdmin(ctx, name, password, ahr)
+						} else {
+							err = couchdb_admin.SetUserPassword(ctx, name, password, ahr)
+						}
+						if err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't change password!")
+							return
+						}
+						log.WithField("name", name).Info("Password successfully changed!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "The user's name",
+						},
+						cli.BoolFlag{
+							Name:  "server-admin",
+							Usage: "Operate on the server admins of every node instead of _users",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"name"}, c)
+					},
+				},
+				{
+					Name:  "roles",
+					Usage: "Replace a user's roles",
+					Action: func(c *cli.Context) {
+						name := c.String("name")
+						roles := listFlag(c, "roles")
+						log.WithFields(log.Fields{"name": name, "roles": roles}).Info("Setting roles...")
+						if err := couchdb_admin.SetUserRoles(ctx, name, roles, buildAuthHttpReq(ctx, c)); err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't set roles!")
+							return
+						}
+						log.WithField("name", name).Info("Roles successfully set!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "The user's name",
+						},
+						cli.StringSliceFlag{
+							Name:  "roles",
+							Usage: "The user's roles, none if not given. Comma separated or given several times",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"name"}, c)
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "Delete a user",
+					Action: func(c *cli.Context) {
+						name := c.String("name")
+						ahr := buildAuthHttpReq(ctx, c)
+
+						var cluster *couchdb_admin.Cluster
+						impact := couchdb_admin.DeleteUserImpact(name)
+						if c.Bool("server-admin") {
+							var err error
+							if cluster, err = couchdb_admin.LoadCluster(ctx, ahr); err != nil {
+								log.WithError(err).Error("Couldn't load cluster!")
+								return
+							}
+							impact = cluster.DeleteAdminImpact(name)
+						}
+						if err := confirm(c, impact); err != nil {
+							log.WithError(err).Error("User was not deleted")
+							return
+						}
+
+						log.WithFields(log.Fields{"name": name, "server-admin": c.Bool("server-admin")}).Info("Deleting user...")
+						var err error
+						if cluster != nil {
+							err = cluster.DeleteAdmin(ctx, name, ahr)
+						} else {
+							err = couchdb_admin.DeleteUser(ctx, name, ahr)
+						}
+						if err != nil {
+							log.WithField("name", name).WithError(err).Error("Couldn't delete user!")
+							return
+						}
+						log.WithField("name", name).Info("User successfully deleted!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "The user's name",
+						},
+						cli.BoolFlag{
+							Name:  "server-admin",
+							Usage: "Operate on the server admins of every node instead of _users",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"name"}, c)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List the users and their roles",
+					Action: func(c *cli.Context) {
+						ahr := buildAuthHttpReq(ctx, c)
+						w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+						defer w.Flush()
+
+						if !c.Bool("server-admin") {
+							users, err := couchdb_admin.ListUsers(ctx, ahr)
+							if err != nil {
+								log.WithError(err).Error("Couldn't list users!")
+								return
+							}
+							fmt.Fprintln(w, "NAME\tROLES")
+							for _, user := range users {
+								fmt.Fprintf(w, "%s\t%s\n", user.Name, strings.Join(user.Roles, ","))
+							}
+							return
+						}
+
+						cluster, err := couchdb_admin.LoadCluster(ctx, ahr)
+						if err != nil {
+							log.WithError(err).Error("Couldn't load cluster!")
+							return
+						}
+						admins, err := cluster.Admins(ctx, ahr)
+						if err != nil {
+							log.WithError(err).Error("Couldn't list server admins!")
+							return
+						}
+						fmt.Fprintln(w, "NODE\tADMINS")
+						for _, node := range cluster.NodesInfo.ClusterNodes {
+							names, up := admins[node]
+							if !up {
+								fmt.Fprintf(w, "%s\t(down)\n", node)
+								continue
+							}
+							fmt.Fprintf(w, "%s\t%s\n", node, strings.Join(names, ","))
+						}
+					},
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "server-admin",
+							Usage: "Operate on the server admins of every node instead of _users",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "replication",
+			Usage: "Manage the replications in the _replicator database",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "Create a replication",
+					Action: func(c *cli.Context) {
+						id := c.String("id")
+						log.WithField("id", id).Info("Creating replication...")
+
+						rep := &couchdb_admin.Replication{
+							Id:           id,
+							Source:       couchdb_admin.NewReplicationEndpoint(c.String("source"), c.String("source-user"), c.String("source-password")),
+							Target:       couchdb_admin.NewReplicationEndpoint(c.String("target"), c.String("target-user"), c.String("target-password")),
+							Continuous:   c.Bool("continuous"),
+							CreateTarget: c.Bool("create-target"),
+							Filter:       c.String("filter"),
+						}
+						if selector := c.String("selector"); selector != "" {
+							var v interface{}
+							if err := json.Unmarshal([]byte(selector), &v); err != nil {
+								log.WithField("selector", selector).WithError(err).Error("Selector is not valid JSON!")
+								return
+							}
+							rep.Selector = json.RawMessage(selector)
+						}
+						for _, param := range c.StringSlice("query-param") {
+							kv := strings.SplitN(param, "=", 2)
+							if len(kv) != 2 {
+								log.WithField("query-param", param).Error("Query params must be given as key=value!")
+								return
+							}
+							if rep.QueryParams == nil {
+								rep.QueryParams = make(map[string]string)
+							}
+							rep.QueryParams[kv[0]] = kv[1]
+						}
+
+						if err := couchdb_admin.CreateReplication(ctx, rep, buildAuthHttpReq(ctx, c)); err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't create replication!")
+							return
+						}
+						log.WithField("id", id).Info("Replication successfully created!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "The replication document id",
+						},
+						cli.StringFlag{
+							Name:  "source",
+							Usage: "The source database url",
+						},
+						cli.StringFlag{
+							Name:  "source-user",
+							Usage: "User to authenticate on the source with",
+						},
+						cli.StringFlag{
+							Name:   "source-password",
+							Usage:  "Password to authenticate on the source with",
+							EnvVar: "COUCHDB_ADMIN_SOURCE_PASSWORD",
+						},
+						cli.StringFlag{
+							Name:  "target",
+							Usage: "The target database url",
+						},
+						cli.StringFlag{
+							Name:  "target-user",
+							Usage: "User to authenticate on the target with",
+						},
+						cli.StringFlag{
+							Name:   "target-password",
+							Usage:  "Password to authenticate on the target with",
+							EnvVar: "COUCHDB_ADMIN_TARGET_PASSWORD",
+						},
+						cli.BoolFlag{
+							Name:  "continuous",
+							Usage: "Keep replicating new changes",
+						},
+						cli.BoolFlag{
+							Name:  "create-target",
+							Usage: "Create the target database if it does not exist",
+						},
+						cli.StringFlag{
+							Name:  "filter",
+							Usage: "Filter function to replicate with, as in ddoc/filter",
+						},
+						cli.StringSliceFlag{
+							Name:  "query-param",
+							Usage: "Parameter for the filter function, as in key=value. Can be given several times",
+						},
+						cli.StringFlag{
+							Name:  "selector",
+							Usage: "Mango selector documents must match to be replicated, as in {\"type\": \"user\"}",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"id", "source", "target"}, c)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List the replication documents",
+					Action: func(c *cli.Context) {
+						reps, err := couchdb_admin.ListReplications(ctx, buildAuthHttpReq(ctx, c))
+						if err != nil {
+							log.WithError(err).Error("Couldn't list replications!")
+							return
+						}
+
+						w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+						fmt.Fprintln(w, "ID\tSOURCE\tTARGET\tCONTINUOUS\tFILTER\tSTATE")
+						for _, rep := range reps {
+							filter := rep.Filter
+							if len(rep.Selector) > 0 {
+								filter = string(rep.Selector)
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", rep.Id, rep.Source, rep.Target, rep.Continuous, filter, rep.State)
+						}
+						w.Flush()
+					},
+				},
+				{
+					Name:  "delete",
+					Usage: "Delete a replication, stopping its job",
+					Action: func(c *cli.Context) {
+						id := c.String("id")
+						ahr := buildAuthHttpReq(ctx, c)
+						impact, err := couchdb_admin.DeleteReplicationImpact(ctx, id, ahr)
+						if err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't load replication!")
+							return
+						}
+						if err = confirm(c, impact); err != nil {
+							log.WithError(err).Error("Replication was not deleted")
+							return
+						}
+
+						log.WithField("id", id).Info("Deleting replication...")
+						if err = couchdb_admin.DeleteReplication(ctx, id, ahr); err != nil {
+							log.WithField("id", id).WithError(err).Error("Couldn't delete replication!")
+							return
+						}
+						log.WithField("id", id).Info("Replication successfully deleted!")
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "id",
+							Usage: "The replication document id",
+						},
+					},
+					Before: func(c *cli.Context) error {
+						return requireFlags([]string{"id"}, c)
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "Show the state of every replication as seen by the scheduler",
+					Action: func(c *cli.Context) {
+						statuses, err := couchdb_admin.ReplicationStatuses(ctx, buildAuthHttpReq(ctx, c))
+						if err != nil {
+							log.WithError(err).Error("Couldn't get replications status!")
+							return
+						}
+
+						w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+						fmt.Fprintln(w, "ID\tSTATE\tNODE\tERRORS\tLAST UPDATE\tSOURCE\tTARGET")
+						for _, status := range statuses {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", status.DocId, status.State, status.Node, status.ErrorCount, status.LastUpdated, status.Source, status.Target)
+						}
+						w.Flush()
+
+						failing := false
+						for _, status := range statuses {
+							if status.Failing() {
+								failing = true
+								log.WithFields(log.Fields{"id": status.DocId, "state": status.State, "errors": status.ErrorCount}).Warnf("Replication is %s: %s", status.State, status.LastError)
+							}
+						}
+						if failing {
+							os.Exit(1)
+						}
+					},
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
+	if journal != nil && journal.failed {
+		fmt.Fprintln(os.Stderr, "Some operations were applied but could not be journaled, they can't be undone!")
+		os.Exit(1)
+	}
+}
+
+func buildAuthHttpReq(ctx context.Context, c *cli.Context) *httpUtils.AuthenticatedHttpRequester {
+	creds := clusterCredentials(c)
+	servers := strings.Split(creds.server, ",")
+	for i := range servers {
+		servers[i] = strings.TrimSpace(servers[i])
+	}
+	ahr := httpUtils.NewAuthenticatedHttpRequester(creds.admin, creds.password, servers...)
+	hosts, _ := nodeHosts(c)
+	ahr.SetNodeHosts(hosts)
+	ahr.SetTimeout(c.GlobalDuration("timeout"))
+
+	switch c.GlobalString("auth") {
+	case "cookie":
+		ahr.SetAuthenticator(httpUtils.NewCookieAuthenticator(creds.admin, creds.password))
+	case "jwt":
+		if file := c.GlobalString("jwt-file"); file != "" {
+			ahr.SetAuthenticator(httpUtils.NewJWTAuthenticatorFromFile(file))
+		} else {
+			ahr.SetAuthenticator(httpUtils.NewJWTAuthenticatorFromEnv(c.GlobalString("jwt-env")))
+		}
+	case "proxy":
+		roles := strings.Split(c.GlobalString("proxy-roles"), ",")
+		ahr.SetAuthenticator(httpUtils.NewProxyAuthenticator(creds.admin, roles, c.GlobalString("proxy-secret")))
+	}
+
+	retryPolicy := httpUtils.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = c.GlobalInt("retries")
+	retryPolicy.InitialBackoff = c.GlobalDuration("retry-backoff")
+	ahr.SetRetryPolicy(retryPolicy)
+
+	if c.GlobalBool("discover-servers") {
+		if err := ahr.DiscoverServers(ctx); err != nil {
+			log.WithError(err).Warn("Couldn't discover the cluster's servers!")
+		}
+		log.WithField("servers", strings.Join(ahr.Servers(), ",")).Debug("Discovered servers")
+	}
+	return ahr
+}
+
+func nodeHosts(c *cli.Context) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, mapping := range c.GlobalStringSlice("node-host") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid node host %s, expected <node>=<host>!", mapping)
+		}
+		node, err := couchdb_admin.ParseNode(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		hosts[node.Addr()] = parts[1]
+	}
+	return hosts, nil
+}
+
+func replicaPolicy(c *cli.Context) (couchdb_admin.ReplicaPolicy, error) {
+	policy := couchdb_admin.ReplicaPolicy{
+		MinReplicas:           c.GlobalInt("min-replicas"),
+		Databases:             make(map[string]int),
+		AllowUnderReplication: c.GlobalBool("allow-under-replication"),
+		RequireZoneSpread:     c.GlobalBool("require-zone-spread"),
+	}
+	for _, override := range c.GlobalStringSlice("db-min-replicas") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return policy, fmt.Errorf("Invalid database minimum replicas %s, expected <db>=<replicas>!", override)
+		}
+		min, err := strconv.Atoi(parts[1])
+		if err != nil || min < 1 {
+			return policy, fmt.Errorf("Invalid database minimum replicas %s, expected <db>=<replicas>!", override)
+		}
+		policy.Databases[parts[0]] = min
+	}
+	return policy, nil
+}
+
+func printTasks(groups []couchdb_admin.TaskGroup, asJSON bool) {
+	if asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(groups); err != nil {
+			log.WithError(err).Error("Couldn't encode tasks!")
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tDB\tNODE\tSHARD\tPROGRESS\tDETAILS")
+	for _, group := range groups {
+		for _, task := range group.Tasks {
+			details := task.DesignDocument
+			if task.Source != "" || task.Target != "" {
+				details = fmt.Sprintf("%s -> %s", task.Source, task.Target)
+			}
+			if task.Phase != "" {
+				details = strings.TrimSpace(details + " " + task.Phase)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d%%\t%s\n", group.Type, group.Database, task.Node, task.Shard(), task.Progress, details)
+		}
+	}
+	w.Flush()
+}
+
+func loadLayout(path string) (couchdb_admin.Layout, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return couchdb_admin.LoadLayout(f)
+}
+
+// interruptibleContext is cancelled on the first SIGINT so that operations
+// stop before their next step. A second SIGINT exits right away.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		log.Warn("Interrupted! Stopping after the current step, interrupt again to exit right away...")
+		cancel()
+		<-signals
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
+
+func databaseFilter(c *cli.Context) (couchdb_admin.DatabaseFilter, error) {
+	filter := couchdb_admin.DatabaseFilter{Glob: c.String("match"), SkipSystem: c.Bool("skip-system")}
+	if expr := c.String("regex"); expr != "" {
+		var err error
+		if filter.Regexp, err = regexp.Compile(expr); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
 }
 
-func buildAuthHttpReq(c *cli.Context) *httpUtils.AuthenticatedHttpRequester {
-	return httpUtils.NewAuthenticatedHttpRequester(c.GlobalString("admin"), c.GlobalString("password"), c.GlobalString("server"))
+// listFlag returns the values of a string slice flag, splitting comma
+// separated ones.
+func listFlag(c *cli.Context, name string) []string {
+	var values []string
+	for _, value := range c.StringSlice(name) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
 }
 
 func requireFlags(names []string, c *cli.Context) error {
@@ -2,6 +2,7 @@ package couchdb_admin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,22 +20,22 @@ type Nodes struct {
 	ClusterNodes []string `json:"cluster_nodes"`
 }
 
-func LoadCluster(ahr *httpUtils.AuthenticatedHttpRequester) (*Cluster, error) {
+func LoadCluster(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (*Cluster, error) {
 	cluster := &Cluster{}
-	if err := cluster.refreshNodesInfo(ahr); err != nil {
+	if err := cluster.refreshNodesInfo(ctx, ahr); err != nil {
 		return nil, err
 	}
 	return cluster, nil
 }
 
-func (c *Cluster) refreshNodesInfo(ahr *httpUtils.AuthenticatedHttpRequester) error {
+func (c *Cluster) refreshNodesInfo(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) error {
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_membership", ahr.Server()), nil)
 	if err != nil {
 		return err
 	}
 
 	var info Nodes
-	if err := ahr.RunRequest(req, &info); err != nil {
+	if err := ahr.RunRequest(ctx, req, &info); err != nil {
 		return err
 	}
 	c.NodesInfo = info
@@ -51,7 +52,7 @@ func (cluster *Cluster) knowsNode(node string) bool {
 	return false
 }
 
-func getLastRevForNode(node string, ahr *httpUtils.AuthenticatedHttpRequester) (string, error) {
+func getLastRevForNode(ctx context.Context, node string, ahr *httpUtils.AuthenticatedHttpRequester) (string, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_nodes/%s", ahr.Server(), node), nil)
 	if err != nil {
 		return "", err
@@ -61,26 +62,38 @@ func getLastRevForNode(node string, ahr *httpUtils.AuthenticatedHttpRequester) (
 		Rev string `json:"_rev"`
 	}{}
 
-	if err = ahr.RunRequest(req, &nodeDetails); err != nil {
+	if err = ahr.RunRequest(ctx, req, &nodeDetails); err != nil {
 		return "", err
 	}
 	return nodeDetails.Rev, nil
 }
 
-func (cluster *Cluster) AddNode(nodeAddr string, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	node := fmt.Sprintf("couchdb@%s", nodeAddr)
+func (cluster *Cluster) AddNode(ctx context.Context, nodeAddr string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	parsed, err := ParseNode(nodeAddr)
+	if err != nil {
+		return err
+	}
+	node := parsed.Addr()
+
+	ctx, release, err := acquireLock(ctx, "add_node", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	if cluster.IsNodeUpAndJoined(node) {
 		return fmt.Errorf("Node: %s is already part of the cluster!", node)
 	}
 
 	body := make(map[string]string)
+	var before map[string]string
 	if cluster.knowsNode(node) {
-		rev, err := getLastRevForNode(node, ahr)
+		rev, err := getLastRevForNode(ctx, node, ahr)
 		if err != nil {
 			return err
 		}
 		body["_rev"] = rev
+		before = map[string]string{"_id": node, "_rev": rev}
 	}
 
 	body_bytes, err := json.Marshal(body)
@@ -95,11 +108,14 @@ func (cluster *Cluster) AddNode(nodeAddr string, ahr *httpUtils.AuthenticatedHtt
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	if err = ahr.RunRequest(req, nil); err != nil {
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	if err = record(ctx, "add_node", node, before, body); err != nil {
 		return err
 	}
 
-	return cluster.refreshNodesInfo(ahr)
+	return cluster.refreshNodesInfo(ctx, ahr)
 }
 
 func (cluster *Cluster) IsNodeUpAndJoined(node string) bool {
@@ -111,21 +127,32 @@ func (cluster *Cluster) IsNodeUpAndJoined(node string) bool {
 	return false
 }
 
-func (cluster *Cluster) RemoveNode(node *Node, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	var dbs []string
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_all_dbs", ahr.Server()), nil)
+func (cluster *Cluster) RemoveNode(ctx context.Context, node *Node, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "remove_node", ahr)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	// Shard ownership is read from a single node, so it is only trusted if every
+	// node agrees on it.
+	inconsistencies, err := cluster.checkSystemDb(ctx, "_dbs", ahr)
+	if err != nil {
+		return err
+	}
+	if len(inconsistencies) > 0 {
+		return fmt.Errorf("Nodes disagree on the shard map of %s, refusing to remove %s until they converge!", inconsistencies[0].Id, node.Addr())
+	}
 
 	log.WithField("node", node.Addr()).Info("Checking that node does not own any shard...")
-	if err = ahr.RunRequest(req, &dbs); err != nil {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
 		return err
 	}
 
 	for _, db_name := range dbs {
 		log.WithFields(log.Fields{"node": node.Addr(), "db": db_name}).Debug("Checking database shards ownership...")
-		db, err := LoadDB(db_name, ahr)
+		db, err := LoadDB(ctx, db_name, ahr)
 		if err != nil {
 			return fmt.Errorf("Could not access the %s database", db_name)
 		}
@@ -134,7 +161,7 @@ func (cluster *Cluster) RemoveNode(node *Node, ahr *httpUtils.AuthenticatedHttpR
 		}
 	}
 
-	req, err = http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_nodes/%s", ahr.Server(), node.Addr()), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_nodes/%s", ahr.Server(), node.Addr()), nil)
 	if err != nil {
 		return err
 	}
@@ -144,7 +171,7 @@ func (cluster *Cluster) RemoveNode(node *Node, ahr *httpUtils.AuthenticatedHttpR
 		Rev string `json:"_rev"`
 	}
 
-	if err = ahr.RunRequest(req, &nodeInfo); err != nil {
+	if err = ahr.RunRequest(ctx, req, &nodeInfo); err != nil {
 		return err
 	}
 
@@ -153,5 +180,8 @@ func (cluster *Cluster) RemoveNode(node *Node, ahr *httpUtils.AuthenticatedHttpR
 		return err
 	}
 
-	return ahr.RunRequest(req, nil)
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "remove_node", node.Addr(), nodeInfo, nil)
 }
@@ -1,10 +1,14 @@
 package couchdb_admin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	httpmock "gopkg.in/jarcoal/httpmock.v1"
 
@@ -22,7 +26,7 @@ func TestLoadClusterLoadsNodesInfo(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1","couchdb@127.0.0.1","couchdb@127.0.0.1"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -31,9 +35,211 @@ func TestLoadClusterLoadsNodesInfo(t *testing.T) {
 	assert.Equal(t, cluster.NodesInfo.ClusterNodes, []string{"couchdb@127.0.0.1", "couchdb@127.0.0.1", "couchdb@127.0.0.1"})
 }
 
+func TestLoadClusterStopsIfCancelled(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		func(req *http.Request) (*http.Response, error) {
+			t.Error("No request should be sent once the context is cancelled")
+			return httpmock.NewStringResponse(200, `{"all_nodes": [], "cluster_nodes": []}`), nil
+		})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	_, err := LoadCluster(ctx, ahr)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestLoadClusterRetriesTransientFailures(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	attempts := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		func(req *http.Request) (*http.Response, error) {
+			attempts++
+			if attempts < 3 {
+				return httpmock.NewStringResponse(503, `{"error": "service_unavailable"}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	ahr.SetRetryPolicy(httpUtils.RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  time.Millisecond,
+		MaxBackoff:      time.Millisecond,
+		RetryableStatus: []int{503},
+	})
+	cluster, err := LoadCluster(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, cluster.NodesInfo.ClusterNodes, []string{"couchdb@127.0.0.1"})
+}
+
+func TestLoadClusterDoesNotRetryClientErrors(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	attempts := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return httpmock.NewStringResponse(401, `{"error": "unauthorized"}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	_, err := LoadCluster(context.Background(), ahr)
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestWritesAreOnlyRetriedWhenTheyNeverReachedTheServer(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	attempts := 0
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.2",
+		func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return httpmock.NewStringResponse(503, `{"error": "service_unavailable"}`), nil
+		})
+
+	dials := 0
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.3",
+		func(req *http.Request) (*http.Response, error) {
+			dials++
+			if dials < 3 {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+			}
+			return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	ahr.SetRetryPolicy(httpUtils.RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  time.Millisecond,
+		MaxBackoff:      time.Millisecond,
+		RetryableStatus: []int{503},
+	})
+
+	req, _ := http.NewRequest("PUT", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.2", strings.NewReader(`{}`))
+	assert.Error(t, ahr.RunRequest(context.Background(), req, nil))
+	assert.Equal(t, 1, attempts)
+
+	req, _ = http.NewRequest("PUT", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.3", strings.NewReader(`{}`))
+	assert.NoError(t, ahr.RunRequest(context.Background(), req, nil))
+	assert.Equal(t, 3, dials)
+}
+
+func TestLoadClusterRenewsExpiredSession(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	logins := 0
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/_session",
+		func(req *http.Request) (*http.Response, error) {
+			logins++
+			assert.Equal(t, "dummyuser", req.FormValue("name"))
+			assert.Equal(t, "dummypassword", req.FormValue("password"))
+
+			resp := httpmock.NewStringResponse(200, `{"ok": true, "name": "dummyuser", "roles": ["_admin"]}`)
+			resp.Header.Set("Set-Cookie", fmt.Sprintf("AuthSession=session%d; Version=1; Path=/; HttpOnly", logins))
+			return resp, nil
+		})
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		func(req *http.Request) (*http.Response, error) {
+			cookie, err := req.Cookie("AuthSession")
+			if err != nil || cookie.Value != "session2" {
+				return httpmock.NewStringResponse(401, `{"error": "unauthorized"}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("", "", "127.0.0.1")
+	ahr.SetAuthenticator(httpUtils.NewCookieAuthenticator("dummyuser", "dummypassword"))
+	cluster, err := LoadCluster(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, cluster.NodesInfo.ClusterNodes, []string{"couchdb@127.0.0.1"})
+}
+
+func TestLoadClusterFailsOverToNextServer(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.9:5984/_membership",
+		func(req *http.Request) (*http.Response, error) {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+		})
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.9", "127.0.0.1")
+	cluster, err := LoadCluster(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, cluster.NodesInfo.ClusterNodes, []string{"couchdb@127.0.0.1"})
+	assert.Equal(t, ahr.Server(), "127.0.0.1")
+}
+
+func TestNodeLocalRequestsToTheCoordinatorFailOver(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	unreachable := func(req *http.Request) (*http.Response, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	}
+	httpmock.RegisterResponder("GET", "http://127.0.0.9:5986/_nodes/_all_docs?include_docs=true", unreachable)
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_nodes/_all_docs?include_docs=true",
+		httpmock.NewStringResponder(200, `{"rows": [{"doc": {"_id": "couchdb@127.0.0.1", "zone": "a"}}]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.9", "127.0.0.1")
+	zones, err := NodeZones(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, map[string]string{"couchdb@127.0.0.1": "a"}, zones)
+	assert.Equal(t, "127.0.0.1", ahr.Server())
+
+	// Requests for a specific node stay on it, even if it was a coordinator.
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/level", unreachable)
+	httpmock.RegisterResponder("GET", "http://127.0.0.9:5984/_node/couchdb@127.0.0.1/_config/log/level",
+		httpmock.NewStringResponder(200, `"info"`))
+
+	node, err := NodeAt("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = node.GetConfig(context.Background(), "log", "level", ahr)
+	assert.Error(t, err)
+}
+
 func TestAddNodeAddsNode(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
 		httpmock.NewStringResponder(200, `{
@@ -41,7 +247,7 @@ func TestAddNodeAddsNode(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -54,7 +260,7 @@ func TestAddNodeAddsNode(t *testing.T) {
 	"all_nodes": ["couchdb@127.0.0.1", "couchdb@111.222.333.444"],
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@111.222.333.444"]}`))
 
-	if err = cluster.AddNode("111.222.333.444", ahr); err != nil {
+	if err = cluster.AddNode(context.Background(), "111.222.333.444", ahr); err != nil {
 		t.Error(err)
 	}
 
@@ -65,6 +271,7 @@ func TestAddNodeAddsNode(t *testing.T) {
 func TestAddNodeRejectsToAddAlreadyAddedNode(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
 		httpmock.NewStringResponder(200, `{
@@ -72,18 +279,19 @@ func TestAddNodeRejectsToAddAlreadyAddedNode(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = cluster.AddNode("127.0.0.1", ahr)
+	err = cluster.AddNode(context.Background(), "127.0.0.1", ahr)
 	assert.Error(t, err, "Node should be rejected as is already part of the cluster")
 }
 
 func TestAddNodeRejoinsNode(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
 		httpmock.NewStringResponder(200, `{
@@ -91,7 +299,7 @@ func TestAddNodeRejoinsNode(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@111.222.333.444"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -122,7 +330,7 @@ func TestAddNodeRejoinsNode(t *testing.T) {
 			"all_nodes": ["couchdb@127.0.0.1", "couchdb@111.222.333.444"],
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@111.222.333.444"]}`))
 
-	if err = cluster.AddNode("111.222.333.444", ahr); err != nil {
+	if err = cluster.AddNode(context.Background(), "111.222.333.444", ahr); err != nil {
 		t.Error(err)
 	}
 
@@ -133,6 +341,7 @@ func TestAddNodeRejoinsNode(t *testing.T) {
 func TestRemoveNodeRemovesNode(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
 		httpmock.NewStringResponder(200, `{
@@ -140,11 +349,16 @@ func TestRemoveNodeRemovesNode(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/_all_docs",
+		httpmock.NewStringResponder(200, `{"rows": [
+			{"id": "_global_changes", "value": {"rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64"}},
+			{"id": "testdb", "value": {"rev": "41-asfefasdfw4543twf09uijkfg829438t"}}]}`))
+
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
 		httpmock.NewStringResponder(200, `["_global_changes", "testdb"]`))
 
@@ -205,7 +419,7 @@ func TestRemoveNodeRemovesNode(t *testing.T) {
 		t.Error(err)
 	}
 
-	if err = cluster.RemoveNode(node, ahr); err != nil {
+	if err = cluster.RemoveNode(context.Background(), node, ahr); err != nil {
 		t.Error(err)
 	}
 }
@@ -213,6 +427,7 @@ func TestRemoveNodeRemovesNode(t *testing.T) {
 func TestRemoveNodeRejectsIfNodeHasReplica(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
 		httpmock.NewStringResponder(200, `{
@@ -220,11 +435,16 @@ func TestRemoveNodeRejectsIfNodeHasReplica(t *testing.T) {
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(context.Background(), ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/_all_docs",
+		httpmock.NewStringResponder(200, `{"rows": [
+			{"id": "_global_changes", "value": {"rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64"}},
+			{"id": "testdb", "value": {"rev": "41-asfefasdfw4543twf09uijkfg829438t"}}]}`))
+
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
 		httpmock.NewStringResponder(200, `["_global_changes", "testdb"]`))
 
@@ -285,6 +505,6 @@ func TestRemoveNodeRejectsIfNodeHasReplica(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = cluster.RemoveNode(node, ahr)
+	err = cluster.RemoveNode(context.Background(), node, ahr)
 	assert.Error(t, err)
 }
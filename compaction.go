@@ -0,0 +1,144 @@
+package couchdb_admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// CompactDatabase triggers the compaction of every shard of a database and, if
+// views is set, of the views of each of its design documents.
+func CompactDatabase(ctx context.Context, name string, views bool, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if err := postCompaction(ctx, fmt.Sprintf("http://%s:5984/%s/_compact", ahr.Server(), name), ahr); err != nil {
+		return err
+	}
+	if !views {
+		return nil
+	}
+
+	ddocs, err := designDocs(ctx, name, ahr)
+	if err != nil {
+		return err
+	}
+	for _, ddoc := range ddocs {
+		log.WithFields(log.Fields{"db": name, "ddoc": ddoc}).Debug("Compacting views...")
+		if err = postCompaction(ctx, fmt.Sprintf("http://%s:5984/%s/_compact/%s", ahr.Server(), name, ddoc), ahr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func postCompaction(ctx context.Context, url string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+// designDocs returns the names of the design documents of a database, without
+// the _design/ prefix.
+func designDocs(ctx context.Context, db string, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	query := url.Values{"startkey": {`"_design/"`}, "endkey": {`"_design0"`}}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_all_docs?%s", ahr.Server(), db, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Id string `json:"id"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	ddocs := make([]string, 0, len(docs.Rows))
+	for _, row := range docs.Rows {
+		ddocs = append(ddocs, strings.TrimPrefix(row.Id, "_design/"))
+	}
+	return ddocs, nil
+}
+
+// CompactionTasks returns the database and view compactions running on any
+// shard of the given database. An empty name returns every compaction.
+func CompactionTasks(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) ([]ActiveTask, error) {
+	tasks, err := ActiveTasks(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	var compactions []ActiveTask
+	for _, task := range tasks {
+		if task.Type != "database_compaction" && task.Type != "view_compaction" {
+			continue
+		}
+		if name == "" || task.DbName() == name {
+			compactions = append(compactions, task)
+		}
+	}
+	return compactions, nil
+}
+
+// compactionStartPolls is how many checks WaitForCompaction waits for a
+// compaction to show up before assuming it was too quick to be seen.
+const compactionStartPolls = 10
+
+// WaitForCompaction blocks until a compaction of the given database has been
+// seen running and has finished, checking every interval. A compaction is
+// running while there is a compaction task on any of its shards or the
+// database reports compact_running.
+func WaitForCompaction(ctx context.Context, name string, interval time.Duration, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	started := false
+	for polls := 1; ; polls++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		tasks, err := CompactionTasks(ctx, name, ahr)
+		if err != nil {
+			return err
+		}
+		running, err := compactRunning(ctx, name, ahr)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(tasks) > 0 || running:
+			started = true
+			log.WithFields(log.Fields{"db": name, "tasks": len(tasks)}).Info("Waiting for compaction to finish...")
+		case started:
+			return nil
+		case polls >= compactionStartPolls:
+			log.WithField("db", name).Warn("Compaction was never seen running, assuming it already finished")
+			return nil
+		default:
+			log.WithField("db", name).Info("Waiting for compaction to start...")
+		}
+	}
+}
+
+func compactRunning(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (bool, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), name), nil)
+	if err != nil {
+		return false, err
+	}
+
+	var info DatabaseInfo
+	if err = ahr.RunRequest(ctx, req, &info); err != nil {
+		return false, err
+	}
+	return info.CompactRunning, nil
+}
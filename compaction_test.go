@@ -0,0 +1,99 @@
+package couchdb_admin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestCompactDatabaseCompactsViews(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var compacted []string
+	compact := func(req *http.Request) (*http.Response, error) {
+		compacted = append(compacted, req.URL.Path)
+		return httpmock.NewStringResponse(202, `{"ok": true}`), nil
+	}
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/testdb/_compact", compact)
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/testdb/_compact/users", compact)
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/testdb/_compact/orders", compact)
+
+	httpmock.RegisterResponder("GET", `http://127.0.0.1:5984/testdb/_all_docs?endkey=%22_design0%22&startkey=%22_design%2F%22`,
+		httpmock.NewStringResponder(200, `{"rows": [{"id": "_design/users"}, {"id": "_design/orders"}]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := CompactDatabase(context.Background(), "testdb", true, ahr); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, compacted, []string{"/testdb/_compact", "/testdb/_compact/users", "/testdb/_compact/orders"})
+}
+
+func TestCompactionTasksReadsEveryNode(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	polls := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_active_tasks",
+		func(req *http.Request) (*http.Response, error) {
+			polls++
+			return httpmock.NewStringResponse(200, `[
+			{"node": "couchdb@127.0.0.1", "type": "database_compaction", "database": "shards/00000000-7fffffff/testdb.1496334581", "progress": 40},
+			{"node": "couchdb@127.0.0.1", "type": "indexer", "database": "shards/00000000-7fffffff/testdb.1496334581", "progress": 10},
+			{"node": "couchdb@127.0.0.2", "type": "view_compaction", "database": "shards/80000000-ffffffff/testdb.1496334581", "design_document": "_design/users", "progress": 75},
+			{"node": "couchdb@127.0.0.2", "type": "database_compaction", "database": "shards/80000000-ffffffff/otherdb.1496334590", "progress": 5}]`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	tasks, err := CompactionTasks(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Len(t, tasks, 2)
+	assert.Equal(t, tasks[0].Node, "couchdb@127.0.0.1")
+	assert.Equal(t, tasks[0].Shard(), "00000000-7fffffff")
+	assert.Equal(t, tasks[0].Progress, 40)
+	assert.Equal(t, tasks[1].Node, "couchdb@127.0.0.2")
+	assert.Equal(t, tasks[1].DbName(), "testdb")
+	assert.Equal(t, tasks[1].DesignDocument, "_design/users")
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb",
+		httpmock.NewStringResponder(200, `{"db_name": "testdb", "compact_running": true}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = WaitForCompaction(ctx, "testdb", time.Millisecond, ahr)
+	assert.Error(t, err, "Waiting should have been stopped by the deadline as compaction never finishes")
+	assert.True(t, polls > 1)
+}
+
+func TestWaitForCompactionWaitsForItToStart(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_active_tasks",
+		httpmock.NewStringResponder(200, `[]`))
+
+	// Not started yet, then running without a task showing up, then done.
+	polls := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			polls++
+			if polls == 2 {
+				return httpmock.NewStringResponse(200, `{"db_name": "testdb", "compact_running": true}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{"db_name": "testdb", "compact_running": false}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := WaitForCompaction(context.Background(), "testdb", time.Millisecond, ahr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, polls, 3)
+}
@@ -0,0 +1,105 @@
+package couchdb_admin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// Inconsistency describes a document of a node-local system database whose
+// revision is not the same on every node.
+type Inconsistency struct {
+	Db   string
+	Id   string
+	Revs map[string]string
+}
+
+// CheckConsistency compares the _nodes and _dbs databases of every node that
+// is up and joined, as read from each node's own local interface.
+func (cluster *Cluster) CheckConsistency(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]Inconsistency, error) {
+	var inconsistencies []Inconsistency
+	for _, db := range []string{"_nodes", "_dbs"} {
+		found, err := cluster.checkSystemDb(ctx, db, ahr)
+		if err != nil {
+			return nil, err
+		}
+		inconsistencies = append(inconsistencies, found...)
+	}
+	return inconsistencies, nil
+}
+
+func (cluster *Cluster) checkSystemDb(ctx context.Context, db string, ahr *httpUtils.AuthenticatedHttpRequester) ([]Inconsistency, error) {
+	var nodes []string
+	for _, node := range cluster.NodesInfo.ClusterNodes {
+		if cluster.IsNodeUpAndJoined(node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	revs := make(map[string]map[string]string)
+	for _, node := range nodes {
+		log.WithFields(log.Fields{"node": node, "db": db}).Debug("Reading node-local documents...")
+		nodeRevs, err := getLocalRevs(ctx, node, db, ahr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s from %s: %s", db, node, err)
+		}
+		for id, rev := range nodeRevs {
+			if revs[id] == nil {
+				revs[id] = make(map[string]string)
+			}
+			revs[id][node] = rev
+		}
+	}
+
+	ids := make([]string, 0, len(revs))
+	for id := range revs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var inconsistencies []Inconsistency
+	for _, id := range ids {
+		consistent := len(revs[id]) == len(nodes)
+		for _, rev := range revs[id] {
+			consistent = consistent && rev == revs[id][nodes[0]]
+		}
+		if consistent {
+			continue
+		}
+		for _, node := range nodes {
+			if _, ok := revs[id][node]; !ok {
+				revs[id][node] = ""
+			}
+		}
+		inconsistencies = append(inconsistencies, Inconsistency{Db: db, Id: id, Revs: revs[id]})
+	}
+	return inconsistencies, nil
+}
+
+func getLocalRevs(ctx context.Context, node, db string, ahr *httpUtils.AuthenticatedHttpRequester) (map[string]string, error) {
+	req, err := httpUtils.NewNodeRequest("GET", fmt.Sprintf("http://%s:5986/%s/_all_docs", ahr.NodeHost(node), db), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Id    string `json:"id"`
+			Value struct {
+				Rev string `json:"rev"`
+			} `json:"value"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	revs := make(map[string]string, len(docs.Rows))
+	for _, row := range docs.Rows {
+		revs[row.Id] = row.Value.Rev
+	}
+	return revs, nil
+}
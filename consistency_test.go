@@ -0,0 +1,54 @@
+package couchdb_admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestCheckConsistencyReportsDivergingDocs(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1", "couchdb@couch-1.svc"],
+	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@couch-1.svc"]}`))
+
+	for _, host := range []string{"127.0.0.1", "10.0.0.2"} {
+		httpmock.RegisterResponder("GET", "http://"+host+":5986/_nodes/_all_docs",
+			httpmock.NewStringResponder(200, `{"rows": [
+				{"id": "couchdb@127.0.0.1", "value": {"rev": "1-a"}},
+				{"id": "couchdb@couch-1.svc", "value": {"rev": "1-b"}}]}`))
+	}
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/_all_docs",
+		httpmock.NewStringResponder(200, `{"rows": [
+			{"id": "testdb", "value": {"rev": "2-c"}},
+			{"id": "otherdb", "value": {"rev": "1-d"}}]}`))
+
+	httpmock.RegisterResponder("GET", "http://10.0.0.2:5986/_dbs/_all_docs",
+		httpmock.NewStringResponder(200, `{"rows": [
+			{"id": "testdb", "value": {"rev": "1-c"}}]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	ahr.SetNodeHosts(map[string]string{"couchdb@couch-1.svc": "10.0.0.2"})
+
+	cluster, err := LoadCluster(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	inconsistencies, err := cluster.CheckConsistency(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, inconsistencies, []Inconsistency{
+		{Db: "_dbs", Id: "otherdb", Revs: map[string]string{"couchdb@127.0.0.1": "1-d", "couchdb@couch-1.svc": ""}},
+		{Db: "_dbs", Id: "testdb", Revs: map[string]string{"couchdb@127.0.0.1": "2-c", "couchdb@couch-1.svc": "1-c"}},
+	})
+}
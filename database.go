@@ -2,9 +2,11 @@ package couchdb_admin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/cabify/couchdb-admin/httpUtils"
 	"github.com/cabify/couchdb-admin/sliceUtils"
@@ -17,55 +19,145 @@ type Database struct {
 
 type Config struct {
 	Id        string              `json:"_id"`
-	Rev       string              `json:"_rev"`
+	Rev       string              `json:"_rev,omitempty"`
 	Shards    []int               `json:"shard_suffix"`
 	Changelog [][]string          `json:"changelog"`
 	ByNode    map[string][]string `json:"by_node"`
 	ByRange   map[string][]string `json:"by_range"`
 }
 
-func LoadDB(name string, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
+// Suffix decodes shard_suffix, which CouchDB stores as the list of the
+// suffix's characters: [46, 49, 52, ...] is ".14...".
+func (c *Config) Suffix() string {
+	suffix := make([]byte, 0, len(c.Shards))
+	for _, ch := range c.Shards {
+		suffix = append(suffix, byte(ch))
+	}
+	return string(suffix)
+}
+
+// ShardDbName returns the name of the node-local database holding the copy of
+// the given range, as in shards/00000000-7fffffff/mydb.1496334581.
+func (c *Config) ShardDbName(shardRange string) string {
+	return fmt.Sprintf("shards/%s/%s%s", shardRange, c.Id, c.Suffix())
+}
+
+func LoadDB(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
 	db := &Database{
 		name: name,
 	}
-	if err := db.refreshDbConfig(ahr); err != nil {
+	if err := db.refreshDbConfig(ctx, ahr); err != nil {
 		return nil, err
 	} else {
 		return db, nil
 	}
 }
 
-func CreateDatabase(name string, replicas, shards int, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s?n=%d&q=%d", ahr.Server(), name, replicas, shards), nil)
+func (db *Database) Config() *Config {
+	return &db.config
+}
+
+func CreateDatabase(ctx context.Context, name string, replicas, shards int, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
+	ctx, release, err := acquireLock(ctx, "create_db", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return createDatabase(ctx, name, fmt.Sprintf("n=%d&q=%d", replicas, shards), ahr)
+}
+
+// CreateDatabaseWithPlacement creates a database whose replicas are spread
+// across zones as told by placement (e.g. zoneA:2,zoneB:1).
+func CreateDatabaseWithPlacement(ctx context.Context, name, placement string, shards int, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
+	zones, err := ParsePlacement(placement)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, release, err := acquireLock(ctx, "create_db", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err = checkPlacement(ctx, zones, ahr); err != nil {
+		return nil, err
+	}
+	return createDatabase(ctx, name, fmt.Sprintf("q=%d&placement=%s", shards, url.QueryEscape(placement)), ahr)
+}
+
+func createDatabase(ctx context.Context, name, query string, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s?%s", ahr.Server(), name, query), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = ahr.RunRequest(req, nil); err != nil {
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
 		return nil, err
 	}
 
-	return LoadDB(name, ahr)
+	db, err := LoadDB(ctx, name, ahr)
+	if err != nil {
+		return nil, err
+	}
+	if err = record(ctx, "create_db", name, nil, db.config); err != nil {
+		return db, err
+	}
+	return db, nil
+}
+
+func ensureDatabase(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), name), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); !httpUtils.IsStatus(err, http.StatusNotFound) {
+		return err
+	}
+
+	req, err = http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), name), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); httpUtils.IsStatus(err, http.StatusPreconditionFailed) {
+		return nil
+	}
+	return err
 }
 
-func (db *Database) refreshDbConfig(ahr *httpUtils.AuthenticatedHttpRequester) error {
+func (db *Database) refreshDbConfig(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) error {
 	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_dbs/%s", ahr.Server(), db.name), nil)
 	if err != nil {
 		return err
 	}
 
-	if err = ahr.RunRequest(req, &db.config); err != nil {
+	// Decoding into a new value so that shards no longer in the map do not
+	// linger from a previous refresh.
+	var config Config
+	if err = ahr.RunRequest(ctx, req, &config); err != nil {
 		return err
 	}
 
-	if db.config.Id == "" {
+	if config.Id == "" {
 		return fmt.Errorf("Could not retrieve config for db: %s", db.name)
 	}
+	db.config = config
 	return nil
 }
 
-func (db *Database) Replicate(shard, replica string, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	replicaNode, err := NodeAt(replica)
+func (db *Database) Replicate(ctx context.Context, shard, replica string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "replicate", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err = db.refreshDbConfig(ctx, ahr); err != nil {
+		return err
+	}
+
+	replicaNode, err := ParseNode(replica)
 	if err != nil {
 		return err
 	}
@@ -78,7 +170,7 @@ func (db *Database) Replicate(shard, replica string, ahr *httpUtils.Authenticate
 		return fmt.Errorf("%s is not a %s's shard!", shard, db.name)
 	}
 
-	cluster, err := LoadCluster(ahr)
+	cluster, err := LoadCluster(ctx, ahr)
 	if err != nil {
 		return err
 	}
@@ -87,28 +179,40 @@ func (db *Database) Replicate(shard, replica string, ahr *httpUtils.Authenticate
 		return fmt.Errorf("%s is not part of the cluster!", replicaNode.Addr())
 	}
 
-	replicaNode.IntoMaintenance(ahr)
+	newRange := append(append([]string(nil), db.config.ByRange[shard]...), replicaNode.Addr())
+	if err = db.checkZoneSpread(ctx, map[string][]string{shard: newRange}, ahr); err != nil {
+		return err
+	}
 
-	db.config.ByNode[replicaNode.Addr()] = append(db.config.ByNode[replicaNode.Addr()], shard)
-	db.config.ByRange[shard] = append(db.config.ByRange[shard], replicaNode.Addr())
-	// TODO add an entry to the changes section.
+	replicaNode.IntoMaintenance(ctx, ahr)
 
-	b, err := json.Marshal(db.config)
+	before, err := json.Marshal(db.config)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5986/_dbs/%s", ahr.Server(), db.name), bytes.NewBuffer(b))
+	db.addReplica(shard, replicaNode.Addr())
+	// TODO add an entry to the changes section.
+
+	return db.saveConfig(ctx, "replicate", before, ahr)
+}
+
+func (db *Database) RemoveReplica(ctx context.Context, shard, from string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "remove_replica", ahr)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	defer release()
 
-	return ahr.RunRequest(req, nil)
-}
+	if err = db.refreshDbConfig(ctx, ahr); err != nil {
+		return err
+	}
 
-func (db *Database) RemoveReplica(shard, from string, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	replica := fmt.Sprintf("couchdb@%s", from)
+	replicaNode, err := ParseNode(from)
+	if err != nil {
+		return err
+	}
+	replica := replicaNode.Addr()
 
 	if _, exists := db.config.ByNode[replica]; !exists {
 		return fmt.Errorf("%s does not have any replicas!", replica)
@@ -118,20 +222,52 @@ func (db *Database) RemoveReplica(shard, from string, ahr *httpUtils.Authenticat
 		return fmt.Errorf("Shard %s is not at %s", shard, replica)
 	}
 
+	if err = db.checkReplicas(ctx, map[string]int{shard: len(db.config.ByRange[shard]) - 1}, ahr); err != nil {
+		return err
+	}
 	newRange := sliceUtils.RemoveItem(db.config.ByRange[shard], replica)
+	if err = db.checkZoneSpread(ctx, map[string][]string{shard: newRange}, ahr); err != nil {
+		return err
+	}
+
+	before, err := json.Marshal(db.config)
+	if err != nil {
+		return err
+	}
+
+	if err := db.removeReplica(shard, replica); err != nil {
+		return err
+	}
+	// TODO add an entry to the changes section.
+
+	return db.saveConfig(ctx, "remove_replica", before, ahr)
+}
+
+func (db *Database) addReplica(shard, node string) {
+	if db.config.ByNode == nil {
+		db.config.ByNode = make(map[string][]string)
+	}
+	db.config.ByNode[node] = append(db.config.ByNode[node], shard)
+	db.config.ByRange[shard] = append(db.config.ByRange[shard], node)
+}
+
+func (db *Database) removeReplica(shard, node string) error {
+	newRange := sliceUtils.RemoveItem(db.config.ByRange[shard], node)
 	if len(newRange) == 0 {
 		return fmt.Errorf("Aborting. Shard %s will be lost if deleted!!", shard)
 	}
 	db.config.ByRange[shard] = newRange
 
-	newNode := sliceUtils.RemoveItem(db.config.ByNode[replica], shard)
+	newNode := sliceUtils.RemoveItem(db.config.ByNode[node], shard)
 	if len(newNode) > 0 {
-		db.config.ByNode[replica] = newNode
+		db.config.ByNode[node] = newNode
 	} else {
-		delete(db.config.ByNode, replica)
+		delete(db.config.ByNode, node)
 	}
-	// TODO add an entry to the changes section.
+	return nil
+}
 
+func (db *Database) saveConfig(ctx context.Context, command string, before json.RawMessage, ahr *httpUtils.AuthenticatedHttpRequester) error {
 	b, err := json.Marshal(db.config)
 	if err != nil {
 		return err
@@ -143,5 +279,8 @@ func (db *Database) RemoveReplica(shard, from string, ahr *httpUtils.Authenticat
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	return ahr.RunRequest(req, nil)
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, command, db.name, before, db.config)
 }
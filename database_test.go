@@ -1,6 +1,7 @@
 package couchdb_admin
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -43,7 +44,7 @@ func TestLoadDBLoadsDB(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -52,6 +53,8 @@ func TestLoadDBLoadsDB(t *testing.T) {
 	assert.Equal(t, db.config.Id, "testdb")
 	assert.Equal(t, db.config.Rev, "1-5e2d10c29c70d3869fb7a1fd3a827a64")
 	assert.Equal(t, db.config.Shards, []int{46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55})
+	assert.Equal(t, db.config.Suffix(), ".1425202577")
+	assert.Equal(t, db.config.ShardDbName("00000000-7fffffff"), "shards/00000000-7fffffff/testdb.1425202577")
 	assert.Equal(t, db.config.Changelog, [][]string{[]string{"add", "00000000-7fffffff", "couchdb@127.0.0.1"}, []string{"add", "80000000-ffffffff", "couchdb@127.0.0.1"}})
 	assert.Equal(t, db.config.ByNode, map[string][]string{"couchdb@127.0.0.1": []string{"00000000-7fffffff", "80000000-ffffffff"}})
 	assert.Equal(t, db.config.ByRange, map[string][]string{"00000000-7fffffff": []string{"couchdb@127.0.0.1"}, "80000000-ffffffff": []string{"couchdb@127.0.0.1"}})
@@ -60,6 +63,7 @@ func TestLoadDBLoadsDB(t *testing.T) {
 func TestCreateDatabaseWorks(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/testdb?n=1&q=2",
 		httpmock.NewStringResponder(200, ""))
@@ -92,7 +96,7 @@ func TestCreateDatabaseWorks(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := CreateDatabase("testdb", 1, 2, ahr)
+	db, err := CreateDatabase(context.Background(), "testdb", 1, 2, ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -109,6 +113,8 @@ func TestCreateDatabaseWorks(t *testing.T) {
 func TestReplicateAddsReplicaToNode(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
+	mockZones(nil)
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -158,7 +164,7 @@ func TestReplicateAddsReplicaToNode(t *testing.T) {
 		})
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -168,7 +174,7 @@ func TestReplicateAddsReplicaToNode(t *testing.T) {
 	"all_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"],
 	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}`))
 
-	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
+	httpmock.RegisterResponder("PUT", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
 		func(req *http.Request) (*http.Response, error) {
 			defer req.Body.Close()
 
@@ -180,7 +186,7 @@ func TestReplicateAddsReplicaToNode(t *testing.T) {
 			return httpmock.NewStringResponse(200, ""), nil
 		})
 
-	if err := db.Replicate("00000000-7fffffff", "127.0.0.2", ahr); err != nil {
+	if err := db.Replicate(context.Background(), "00000000-7fffffff", "127.0.0.2", ahr); err != nil {
 		t.Error(err)
 	}
 
@@ -199,6 +205,7 @@ func TestReplicateAddsReplicaToNode(t *testing.T) {
 func TestReplicateFailsIfNodeIsAlreadyReplica(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -228,12 +235,12 @@ func TestReplicateFailsIfNodeIsAlreadyReplica(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Replicate("00000000-7fffffff", "127.0.0.1", ahr)
+	err = db.Replicate(context.Background(), "00000000-7fffffff", "127.0.0.1", ahr)
 	assert.Error(t, err, "Replica should have been rejected as 127.0.0.1 already contains a replica for the shard")
 
 	assert.Equal(t, db.config.ByNode, map[string][]string{
@@ -248,6 +255,7 @@ func TestReplicateFailsIfNodeIsAlreadyReplica(t *testing.T) {
 func TestReplicateFailsIfShardDoesNotExist(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -277,12 +285,12 @@ func TestReplicateFailsIfShardDoesNotExist(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.Replicate("dummy_shard", "127.0.0.1", ahr)
+	err = db.Replicate(context.Background(), "dummy_shard", "127.0.0.1", ahr)
 	assert.Error(t, err, "Replica should have been rejected as dummy_shard is not an existing DB shard")
 
 	assert.Equal(t, db.config.ByNode, map[string][]string{
@@ -297,6 +305,7 @@ func TestReplicateFailsIfShardDoesNotExist(t *testing.T) {
 func TestReplicateFailsIfNodeIsNotPartOfTheCluster(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -326,7 +335,7 @@ func TestReplicateFailsIfNodeIsNotPartOfTheCluster(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -336,7 +345,7 @@ func TestReplicateFailsIfNodeIsNotPartOfTheCluster(t *testing.T) {
 	"all_nodes": ["couchdb@127.0.0.1"],
 	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
 
-	err = db.Replicate("00000000-7fffffff", "dummy_server", ahr)
+	err = db.Replicate(context.Background(), "00000000-7fffffff", "dummy_server", ahr)
 	assert.Error(t, err, "Replica should have been rejected as dummy_server is not part of the cluster")
 
 	assert.Equal(t, db.config.ByNode, map[string][]string{
@@ -351,6 +360,10 @@ func TestReplicateFailsIfNodeIsNotPartOfTheCluster(t *testing.T) {
 func TestRemoveReplicaWorks(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+	mockLocks()
+	mockZones(nil)
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -394,7 +407,7 @@ func TestRemoveReplicaWorks(t *testing.T) {
 				"80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -419,7 +432,7 @@ func TestRemoveReplicaWorks(t *testing.T) {
 			return httpmock.NewStringResponse(200, ""), nil
 		})
 
-	if err := db.RemoveReplica("00000000-7fffffff", "127.0.0.2", ahr); err != nil {
+	if err := db.RemoveReplica(context.Background(), "00000000-7fffffff", "127.0.0.2", ahr); err != nil {
 		t.Error(err)
 	}
 
@@ -436,6 +449,7 @@ func TestRemoveReplicaWorks(t *testing.T) {
 func TestRemoveReplicaFailsIfNodeDoesNotContainShard(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -458,15 +472,15 @@ func TestRemoveReplicaFailsIfNodeDoesNotContainShard(t *testing.T) {
 		}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.RemoveReplica("dummy_replica", "127.0.0.1", ahr)
+	err = db.RemoveReplica(context.Background(), "dummy_replica", "127.0.0.1", ahr)
 	assert.Error(t, err, "Remove replica operation should have been rejected as the replica does not exist!")
 
-	err = db.RemoveReplica("80000000-ffffffff", "dummy_server", ahr)
+	err = db.RemoveReplica(context.Background(), "80000000-ffffffff", "dummy_server", ahr)
 	assert.Error(t, err, "Remove replica operation should have been rejected as the server does not exist!")
 
 	assert.Equal(t, db.config.ByNode, map[string][]string{
@@ -480,6 +494,7 @@ func TestRemoveReplicaFailsIfNodeDoesNotContainShard(t *testing.T) {
 func TestRemoveReplicaFailsIfShardWillBeLost(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	mockLocks()
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -502,12 +517,12 @@ func TestRemoveReplicaFailsIfShardWillBeLost(t *testing.T) {
 		}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = db.RemoveReplica("00000000-7fffffff", "127.0.0.1", ahr)
+	err = db.RemoveReplica(context.Background(), "00000000-7fffffff", "127.0.0.1", ahr)
 	assert.Error(t, err, "Remove replica operation should have been rejected as the replica will be lost!")
 
 	assert.Equal(t, db.config.ByNode, map[string][]string{
@@ -521,6 +536,10 @@ func TestRemoveReplicaFailsIfShardWillBeLost(t *testing.T) {
 func TestRemoveReplicaRemovesNodeIfEmpty(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+	mockLocks()
+	mockZones(nil)
 
 	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
 		httpmock.NewStringResponder(200, `{
@@ -549,7 +568,7 @@ func TestRemoveReplicaRemovesNodeIfEmpty(t *testing.T) {
 		}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	db, err := LoadDB("testdb", ahr)
+	db, err := LoadDB(context.Background(), "testdb", ahr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -572,7 +591,7 @@ func TestRemoveReplicaRemovesNodeIfEmpty(t *testing.T) {
 			return httpmock.NewStringResponse(200, ""), nil
 		})
 
-	if err := db.RemoveReplica("00000000-ffffffff", "127.0.0.2", ahr); err != nil {
+	if err := db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr); err != nil {
 		t.Error(err)
 	}
 
@@ -592,6 +611,6 @@ func TestFailureLoadingDBRaisesError(t *testing.T) {
 		httpmock.NewStringResponder(200, `{}`))
 
 	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
-	_, err := LoadDB("testdb", ahr)
+	_, err := LoadDB(context.Background(), "testdb", ahr)
 	assert.Error(t, err)
 }
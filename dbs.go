@@ -0,0 +1,205 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/cabify/couchdb-admin/sliceUtils"
+)
+
+var protectedDbs = []string{"_users", "_replicator", "_global_changes", LocksDb}
+
+type DatabaseInfo struct {
+	Name        string `json:"db_name"`
+	DocCount    int64  `json:"doc_count"`
+	DocDelCount int64  `json:"doc_del_count"`
+	Sizes       struct {
+		File     int64 `json:"file"`
+		External int64 `json:"external"`
+		Active   int64 `json:"active"`
+	} `json:"sizes"`
+	Cluster struct {
+		Q int `json:"q"`
+		N int `json:"n"`
+		W int `json:"w"`
+		R int `json:"r"`
+	} `json:"cluster"`
+	CompactRunning bool `json:"compact_running"`
+}
+
+// DatabaseFilter selects databases by name. Empty fields match everything.
+type DatabaseFilter struct {
+	Glob       string
+	Regexp     *regexp.Regexp
+	SkipSystem bool
+}
+
+func (f DatabaseFilter) Match(name string) bool {
+	if f.SkipSystem && IsSystemDatabase(name) {
+		return false
+	}
+	if f.Glob != "" {
+		if matched, _ := path.Match(f.Glob, name); !matched {
+			return false
+		}
+	}
+	return f.Regexp == nil || f.Regexp.MatchString(name)
+}
+
+func IsSystemDatabase(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// IsProtectedDatabase tells whether name is a system database CouchDB needs
+// to work properly, or one this tool keeps its locks or journal in.
+func IsProtectedDatabase(name string) bool {
+	if db, ok := journal.(databaseJournal); ok && db.Database() == name {
+		return true
+	}
+	return sliceUtils.Contains(protectedDbs, name)
+}
+
+func AllDbs(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_all_dbs", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbs []string
+	if err = ahr.RunRequest(ctx, req, &dbs); err != nil {
+		return nil, err
+	}
+	return dbs, nil
+}
+
+// ListDatabases returns the information of every database matching filter.
+func ListDatabases(ctx context.Context, filter DatabaseFilter, ahr *httpUtils.AuthenticatedHttpRequester) ([]DatabaseInfo, error) {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range dbs {
+		if filter.Match(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return DatabasesInfo(ctx, names, ahr)
+}
+
+// dbsInfoMaxKeys is the most databases CouchDB accepts in a single _dbs_info
+// request.
+const dbsInfoMaxKeys = 100
+
+// DatabasesInfo gets the information of the given databases from _dbs_info,
+// falling back to querying them one by one on versions lacking it.
+func DatabasesInfo(ctx context.Context, names []string, ahr *httpUtils.AuthenticatedHttpRequester) ([]DatabaseInfo, error) {
+	infos := make([]DatabaseInfo, 0, len(names))
+	for len(names) > 0 {
+		chunk := names
+		if len(chunk) > dbsInfoMaxKeys {
+			chunk = chunk[:dbsInfoMaxKeys]
+		}
+
+		chunkInfos, err := databasesInfoChunk(ctx, chunk, ahr)
+		if httpUtils.IsStatus(err, http.StatusNotFound) || httpUtils.IsStatus(err, http.StatusMethodNotAllowed) {
+			rest, err := databasesInfoOneByOne(ctx, names, ahr)
+			if err != nil {
+				return nil, err
+			}
+			return append(infos, rest...), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, chunkInfos...)
+		names = names[len(chunk):]
+	}
+	return infos, nil
+}
+
+func databasesInfoChunk(ctx context.Context, names []string, ahr *httpUtils.AuthenticatedHttpRequester) ([]DatabaseInfo, error) {
+	b, err := json.Marshal(map[string][]string{"keys": names})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:5984/_dbs_info", ahr.Server()), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var results []struct {
+		Key   string       `json:"key"`
+		Info  DatabaseInfo `json:"info"`
+		Error string       `json:"error"`
+	}
+	if err = ahr.RunRequest(ctx, req, &results); err != nil {
+		return nil, err
+	}
+
+	infos := make([]DatabaseInfo, 0, len(results))
+	for _, result := range results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("Could not get info of %s: %s", result.Key, result.Error)
+		}
+		infos = append(infos, result.Info)
+	}
+	return infos, nil
+}
+
+func databasesInfoOneByOne(ctx context.Context, names []string, ahr *httpUtils.AuthenticatedHttpRequester) ([]DatabaseInfo, error) {
+	infos := make([]DatabaseInfo, 0, len(names))
+	for _, name := range names {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), name), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var info DatabaseInfo
+		if err = ahr.RunRequest(ctx, req, &info); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// DeleteDatabase deletes a database along with all its data. System databases
+// are only deleted if force is given.
+func DeleteDatabase(ctx context.Context, name string, force bool, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if IsProtectedDatabase(name) && !force {
+		return fmt.Errorf("Refusing to delete system database %s!", name)
+	}
+
+	ctx, release, err := acquireLock(ctx, "delete_db", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	db, err := LoadDB(ctx, name, ahr)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), name), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "delete_db", name, db.config, nil)
+}
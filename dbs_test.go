@@ -0,0 +1,137 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestListDatabasesFiltersAndGetsInfo(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["_replicator", "_users", "tenant_a", "tenant_b", "other"]`))
+
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/_dbs_info",
+		httpmock.NewStringResponder(200, `[
+			{"key": "tenant_a", "info": {"db_name": "tenant_a", "doc_count": 10, "sizes": {"file": 2048}, "cluster": {"q": 8, "n": 3}}},
+			{"key": "tenant_b", "info": {"db_name": "tenant_b", "doc_count": 0, "sizes": {"file": 1024}, "cluster": {"q": 2, "n": 1}}}]`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	infos, err := ListDatabases(context.Background(), DatabaseFilter{Glob: "tenant_*", SkipSystem: true}, ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Len(t, infos, 2)
+	assert.Equal(t, infos[0].Name, "tenant_a")
+	assert.Equal(t, infos[0].DocCount, int64(10))
+	assert.Equal(t, infos[0].Sizes.File, int64(2048))
+	assert.Equal(t, infos[0].Cluster.N, 3)
+	assert.Equal(t, infos[1].Cluster.Q, 2)
+}
+
+func TestDatabasesInfoSendsAtMostAHundredKeysPerRequest(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var requests int
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/_dbs_info",
+		func(req *http.Request) (*http.Response, error) {
+			requests++
+			var body struct {
+				Keys []string `json:"keys"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			if len(body.Keys) > 100 {
+				return httpmock.NewStringResponse(400, `{"error": "bad_request"}`), nil
+			}
+			results := make([]map[string]interface{}, 0, len(body.Keys))
+			for _, key := range body.Keys {
+				results = append(results, map[string]interface{}{"key": key, "info": map[string]string{"db_name": key}})
+			}
+			return httpmock.NewJsonResponse(200, results)
+		})
+
+	var names []string
+	for i := 0; i < 250; i++ {
+		names = append(names, fmt.Sprintf("db%d", i))
+	}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	infos, err := DatabasesInfo(context.Background(), names, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, requests)
+	assert.Len(t, infos, 250)
+	assert.Equal(t, "db0", infos[0].Name)
+	assert.Equal(t, "db249", infos[249].Name)
+}
+
+func TestDatabaseFilterMatches(t *testing.T) {
+	filter := DatabaseFilter{Regexp: regexp.MustCompile(`^tenant_\d+$`), SkipSystem: true}
+	assert.True(t, filter.Match("tenant_1"))
+	assert.False(t, filter.Match("tenant_a"))
+	assert.False(t, DatabaseFilter{SkipSystem: true}.Match("_users"))
+	assert.True(t, DatabaseFilter{}.Match("_users"))
+}
+
+func TestDeleteDatabaseRefusesSystemDatabases(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	err := DeleteDatabase(context.Background(), "_users", false, ahr)
+	assert.Error(t, err, "_users should not be deleted unless forced")
+}
+
+func TestLocksAndJournalDatabasesAreProtected(t *testing.T) {
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	SetJournal(NewDatabaseJournal("ops_journal", ahr), "tester")
+	defer SetJournal(nil, "")
+
+	assert.True(t, IsProtectedDatabase(LocksDb))
+	assert.True(t, IsProtectedDatabase("ops_journal"))
+	assert.False(t, IsProtectedDatabase("testdb"))
+}
+
+func TestDeleteDatabaseDeletesDatabase(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {"couchdb@127.0.0.1": ["00000000-ffffffff"]},
+			"by_range": {"00000000-ffffffff": ["couchdb@127.0.0.1"]}}`))
+
+	deleted := false
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			deleted = true
+			return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := DeleteDatabase(context.Background(), "testdb", false, ahr); err != nil {
+		t.Error(err)
+	}
+	assert.True(t, deleted)
+}
@@ -0,0 +1,393 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+const stagedSuffix = "_new"
+
+// DesignDoc is the body of a design document, without _id nor _rev.
+type DesignDoc map[string]interface{}
+
+type PushOptions struct {
+	// Staged uploads changed design documents with views as
+	// _design/<name>_new, waits for their indexes to be built and only then
+	// copies them over _design/<name>, so that reads never wait for the
+	// indexes to be rebuilt.
+	Staged       bool
+	PollInterval time.Duration
+}
+
+// LoadDesignDocs reads the design documents in dir by name. Each one is either
+// a <name>.json file or a <name> directory with views/<view>/map.js and,
+// optionally, views/<view>/reduce.js and validate_doc_update.js.
+func LoadDesignDocs(dir string) (map[string]DesignDoc, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ddocs := make(map[string]DesignDoc)
+	for _, entry := range entries {
+		var name string
+		var ddoc DesignDoc
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			name = entry.Name()
+			ddoc, err = loadDesignDocDir(path)
+		case filepath.Ext(entry.Name()) == ".json":
+			name = strings.TrimSuffix(entry.Name(), ".json")
+			ddoc, err = loadDesignDocFile(path)
+			if id, ok := ddoc["_id"].(string); ok {
+				name = strings.TrimPrefix(id, "_design/")
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read design document %s: %s", path, err)
+		}
+
+		delete(ddoc, "_id")
+		delete(ddoc, "_rev")
+		if _, exists := ddocs[name]; exists {
+			return nil, fmt.Errorf("Design document %s is given twice in %s!", name, dir)
+		}
+		ddocs[name] = ddoc
+	}
+	return ddocs, nil
+}
+
+func loadDesignDocFile(path string) (DesignDoc, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ddoc DesignDoc
+	if err = json.Unmarshal(b, &ddoc); err != nil {
+		return nil, err
+	}
+	return ddoc, nil
+}
+
+func loadDesignDocDir(dir string) (DesignDoc, error) {
+	ddoc := DesignDoc{"language": "javascript"}
+
+	views, err := ioutil.ReadDir(filepath.Join(dir, "views"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(views) > 0 {
+		viewsDoc := make(map[string]interface{})
+		for _, view := range views {
+			if !view.IsDir() {
+				continue
+			}
+			viewDir := filepath.Join(dir, "views", view.Name())
+			mapFn, err := readFunction(filepath.Join(viewDir, "map.js"))
+			if err != nil {
+				return nil, err
+			}
+			viewDoc := map[string]interface{}{"map": mapFn}
+			if reduceFn, err := readFunction(filepath.Join(viewDir, "reduce.js")); err == nil {
+				viewDoc["reduce"] = reduceFn
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+			viewsDoc[view.Name()] = viewDoc
+		}
+		ddoc["views"] = viewsDoc
+	}
+
+	if validate, err := readFunction(filepath.Join(dir, "validate_doc_update.js")); err == nil {
+		ddoc["validate_doc_update"] = validate
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ddoc, nil
+}
+
+func readFunction(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// PushDesignDocs uploads the design documents that differ from the ones in the
+// database, returning the names of those uploaded.
+func PushDesignDocs(ctx context.Context, db string, ddocs map[string]DesignDoc, opts PushOptions, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	ctx, release, err := acquireLock(ctx, "push_ddocs", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	names := make([]string, 0, len(ddocs))
+	for name := range ddocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pushed []string
+	for _, name := range names {
+		ddoc := ddocs[name]
+		current, rev, err := getDesignDoc(ctx, db, name, ahr)
+		if err != nil {
+			return pushed, err
+		}
+		if sameDesignDoc(current, ddoc) {
+			log.WithFields(log.Fields{"db": db, "ddoc": name}).Debug("Design document is up to date")
+			continue
+		}
+
+		if opts.Staged && ddoc["views"] != nil && ddoc["language"] != "query" {
+			err = stageDesignDoc(ctx, db, name, ddoc, rev, opts.PollInterval, ahr)
+		} else {
+			err = putDesignDoc(ctx, db, name, ddoc, rev, ahr)
+		}
+		if err != nil {
+			return pushed, fmt.Errorf("Could not push design document %s: %s", name, err)
+		}
+		pushed = append(pushed, name)
+		if err = record(ctx, "push_ddoc", db+"/_design/"+name, current, ddoc); err != nil {
+			return pushed, err
+		}
+	}
+	return pushed, nil
+}
+
+// stageDesignDoc deploys ddoc as a copy of itself, waits for the copy's views
+// to be built and then copies it over the live one. Both share their index as
+// their views are the same.
+func stageDesignDoc(ctx context.Context, db, name string, ddoc DesignDoc, rev string, interval time.Duration, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	staged := name + stagedSuffix
+	_, stagedRev, err := getDesignDoc(ctx, db, staged, ahr)
+	if err != nil {
+		return err
+	}
+	if err = putDesignDoc(ctx, db, staged, ddoc, stagedRev, ahr); err != nil {
+		return err
+	}
+
+	if err = triggerIndexing(ctx, db, staged, ddoc, ahr); err != nil {
+		return err
+	}
+	if err = WaitForIndexing(ctx, db, staged, interval, ahr); err != nil {
+		return err
+	}
+
+	destination := "_design/" + name
+	if rev != "" {
+		destination += "?rev=" + rev
+	}
+	req, err := http.NewRequest("COPY", fmt.Sprintf("http://%s:5984/%s/_design/%s", ahr.Server(), db, staged), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", destination)
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+
+	_, stagedRev, err = getDesignDoc(ctx, db, staged, ahr)
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/%s/_design/%s?rev=%s", ahr.Server(), db, staged, stagedRev), nil)
+	if err != nil {
+		return err
+	}
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+// triggerIndexing queries one of the design document's views so that their
+// index starts being built, without waiting for it.
+func triggerIndexing(ctx context.Context, db, name string, ddoc DesignDoc, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	views, _ := ddoc["views"].(map[string]interface{})
+	for view := range views {
+		log.WithFields(log.Fields{"db": db, "ddoc": name, "view": view}).Debug("Triggering indexing...")
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_design/%s/_view/%s?limit=0&stale=update_after", ahr.Server(), db, name, view), nil)
+		if err != nil {
+			return err
+		}
+		return ahr.RunRequest(ctx, req, nil)
+	}
+	return nil
+}
+
+// indexingStartPolls is how many times WaitForIndexing looks for an indexer
+// before relying only on the design document's update sequence, as small
+// indexes can be built before the first poll.
+const indexingStartPolls = 10
+
+// WaitForIndexing blocks until no shard of db is building the indexes of the
+// given design document, checking every interval. Once no indexer is left the
+// indexes must also have caught up with the updates the database had when
+// called.
+func WaitForIndexing(ctx context.Context, db, ddoc string, interval time.Duration, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	var dbInfo struct {
+		UpdateSeq json.RawMessage `json:"update_seq"`
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), db), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, &dbInfo); err != nil {
+		return err
+	}
+	target, err := seqNumber(dbInfo.UpdateSeq)
+	if err != nil {
+		return err
+	}
+
+	started := false
+	for polls := 1; ; polls++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		tasks, err := ActiveTasks(ctx, ahr)
+		if err != nil {
+			return err
+		}
+		indexing := 0
+		for _, task := range tasks {
+			if task.Type == "indexer" && task.DbName() == db && task.DesignDocument == "_design/"+ddoc {
+				indexing++
+			}
+		}
+
+		switch {
+		case indexing > 0:
+			started = true
+			log.WithFields(log.Fields{"db": db, "ddoc": ddoc, "tasks": indexing}).Info("Waiting for indexing to finish...")
+		case !started && polls < indexingStartPolls:
+			log.WithFields(log.Fields{"db": db, "ddoc": ddoc}).Info("Waiting for indexing to start...")
+		default:
+			indexed, err := indexedSeq(ctx, db, ddoc, ahr)
+			if err != nil {
+				return err
+			}
+			if indexed >= target {
+				if !started {
+					log.WithFields(log.Fields{"db": db, "ddoc": ddoc}).Warn("Indexing was never seen running, but the indexes are up to date")
+				}
+				return nil
+			}
+			log.WithFields(log.Fields{"db": db, "ddoc": ddoc, "indexed": indexed, "target": target}).Info("Waiting for indexing to catch up...")
+		}
+	}
+}
+
+// indexedSeq returns the update sequence the design document's indexes have
+// been built up to.
+func indexedSeq(ctx context.Context, db, ddoc string, ahr *httpUtils.AuthenticatedHttpRequester) (int64, error) {
+	var info struct {
+		ViewIndex struct {
+			UpdateSeq json.RawMessage `json:"update_seq"`
+		} `json:"view_index"`
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_design/%s/_info", ahr.Server(), db, ddoc), nil)
+	if err != nil {
+		return 0, err
+	}
+	if err = ahr.RunRequest(ctx, req, &info); err != nil {
+		return 0, err
+	}
+	return seqNumber(info.ViewIndex.UpdateSeq)
+}
+
+// seqNumber returns the numeric part of an update sequence, which CouchDB 2
+// and later prefix to the opaque clustered sequence.
+func seqNumber(seq json.RawMessage) (int64, error) {
+	s := strings.Trim(string(seq), `"`)
+	if i := strings.Index(s, "-"); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read update sequence %s!", seq)
+	}
+	return n, nil
+}
+
+// getDesignDoc returns the design document without its _id and _rev, and its
+// revision. Both are empty if it does not exist.
+func getDesignDoc(ctx context.Context, db, name string, ahr *httpUtils.AuthenticatedHttpRequester) (DesignDoc, string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_design/%s", ahr.Server(), db, name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var ddoc DesignDoc
+	if err = ahr.RunRequest(ctx, req, &ddoc); err != nil {
+		if httpUtils.IsStatus(err, http.StatusNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	rev, _ := ddoc["_rev"].(string)
+	delete(ddoc, "_id")
+	delete(ddoc, "_rev")
+	return ddoc, rev, nil
+}
+
+func putDesignDoc(ctx context.Context, db, name string, ddoc DesignDoc, rev string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	doc := make(map[string]interface{}, len(ddoc)+2)
+	for k, v := range ddoc {
+		doc[k] = v
+	}
+	doc["_id"] = "_design/" + name
+	if rev != "" {
+		doc["_rev"] = rev
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s/_design/%s", ahr.Server(), db, name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+// sameDesignDoc compares design documents as JSON, so that numbers decoded
+// from different sources compare equal.
+func sameDesignDoc(a, b DesignDoc) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var ja, jb interface{}
+	ba, errA := json.Marshal(a)
+	bb, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	if json.Unmarshal(ba, &ja) != nil || json.Unmarshal(bb, &jb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(ja, jb)
+}
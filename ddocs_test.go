@@ -0,0 +1,171 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadDesignDocsFromFilesAndDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchdb-admin-ddocs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"orders.json":                  `{"_id": "_design/orders", "_rev": "3-abc", "views": {"by_date": {"map": "function(doc) { emit(doc.date); }"}}}`,
+		"users/views/by_email/map.js":  "function(doc) { emit(doc.email); }\n",
+		"users/views/count/map.js":     "function(doc) { emit(doc.type); }",
+		"users/views/count/reduce.js":  "_count",
+		"users/validate_doc_update.js": "function(newDoc) {}",
+		"README.md":                    "Not a design document",
+	})
+
+	ddocs, err := LoadDesignDocs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ddocs["orders"], DesignDoc{
+		"views": map[string]interface{}{"by_date": map[string]interface{}{"map": "function(doc) { emit(doc.date); }"}},
+	})
+	assert.Equal(t, ddocs["users"], DesignDoc{
+		"language": "javascript",
+		"views": map[string]interface{}{
+			"by_email": map[string]interface{}{"map": "function(doc) { emit(doc.email); }"},
+			"count":    map[string]interface{}{"map": "function(doc) { emit(doc.type); }", "reduce": "_count"},
+		},
+		"validate_doc_update": "function(newDoc) {}",
+	})
+	assert.Len(t, ddocs, 2)
+}
+
+func TestPushDesignDocsOnlyUploadsChangedOnes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/orders",
+		httpmock.NewStringResponder(200, `{"_id": "_design/orders", "_rev": "1-abc", "views": {"by_date": {"map": "function(doc) { emit(doc.date); }"}}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/users",
+		httpmock.NewStringResponder(200, `{"_id": "_design/users", "_rev": "2-def", "views": {"by_email": {"map": "function(doc) { emit(doc.mail); }"}}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/reports",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "missing"}`))
+
+	written := make(map[string]map[string]interface{})
+	put := func(req *http.Request) (*http.Response, error) {
+		var doc map[string]interface{}
+		b, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		written[doc["_id"].(string)] = doc
+		return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+	}
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/testdb/_design/users", put)
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/testdb/_design/reports", put)
+
+	ddocs := map[string]DesignDoc{
+		"orders":  {"views": map[string]interface{}{"by_date": map[string]interface{}{"map": "function(doc) { emit(doc.date); }"}}},
+		"users":   {"views": map[string]interface{}{"by_email": map[string]interface{}{"map": "function(doc) { emit(doc.email); }"}}},
+		"reports": {"validate_doc_update": "function(newDoc) {}"},
+	}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	pushed, err := PushDesignDocs(context.Background(), "testdb", ddocs, PushOptions{}, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, pushed, []string{"reports", "users"})
+	assert.Equal(t, written["_design/users"]["_rev"], "2-def")
+	assert.NotContains(t, written["_design/reports"], "_rev")
+}
+
+func TestStagedPushSwapsOnceIndexed(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	var calls []string
+	respond := func(status int, body string) httpmock.Responder {
+		return func(req *http.Request) (*http.Response, error) {
+			calls = append(calls, req.Method+" "+req.URL.Path)
+			return httpmock.NewStringResponse(status, body), nil
+		}
+	}
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/users",
+		respond(200, `{"_id": "_design/users", "_rev": "2-def", "views": {"by_email": {"map": "function(doc) { emit(doc.mail); }"}}}`))
+	stagedGets := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/users_new",
+		func(req *http.Request) (*http.Response, error) {
+			stagedGets++
+			if stagedGets == 1 {
+				return httpmock.NewStringResponse(404, `{"error": "not_found", "reason": "missing"}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{"_id": "_design/users_new", "_rev": "1-fed"}`), nil
+		})
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/testdb/_design/users_new", respond(201, `{"ok": true}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/users_new/_view/by_email?limit=0&stale=update_after",
+		respond(200, `{"total_rows": 0, "rows": []}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb",
+		httpmock.NewStringResponder(200, `{"db_name": "testdb", "update_seq": "42-g1AAAAFTeJzLYWBg4MhgTmHgz8tPSTV0MDQy1zMAQsMcoARTIkOS_P___7MSGXAqSlIAkkn2IFUZzIkMuUAB9pQUA0MDA4M0bGqx6E0yE"}`))
+	polls := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_active_tasks",
+		func(req *http.Request) (*http.Response, error) {
+			polls++
+			if polls == 1 {
+				return httpmock.NewStringResponse(200, `[{"node": "couchdb@127.0.0.1", "type": "indexer", "database": "shards/00000000-ffffffff/testdb.1496334581", "design_document": "_design/users_new", "progress": 50}]`), nil
+			}
+			return httpmock.NewStringResponse(200, `[]`), nil
+		})
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_design/users_new/_info",
+		httpmock.NewStringResponder(200, `{"name": "users_new", "view_index": {"update_seq": "42-g1AAAAFTeJzLYWBg4MhgTmHgz8tPSTV0MDQy1zMAQsMcoARTIkOS", "updater_running": false}}`))
+	httpmock.RegisterResponder("COPY", "http://127.0.0.1:5984/testdb/_design/users_new",
+		func(req *http.Request) (*http.Response, error) {
+			calls = append(calls, "COPY "+req.Header.Get("Destination"))
+			return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+		})
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/testdb/_design/users_new?rev=1-fed", respond(200, `{"ok": true}`))
+
+	ddocs := map[string]DesignDoc{
+		"users": {"views": map[string]interface{}{"by_email": map[string]interface{}{"map": "function(doc) { emit(doc.email); }"}}},
+	}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	pushed, err := PushDesignDocs(context.Background(), "testdb", ddocs, PushOptions{Staged: true, PollInterval: time.Millisecond}, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, pushed, []string{"users"})
+	assert.Equal(t, polls, 2)
+	assert.Equal(t, calls, []string{
+		"GET /testdb/_design/users",
+		"PUT /testdb/_design/users_new",
+		"GET /testdb/_design/users_new/_view/by_email",
+		"COPY _design/users?rev=2-def",
+		"DELETE /testdb/_design/users_new",
+	})
+}
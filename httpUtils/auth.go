@@ -0,0 +1,185 @@
+package httpUtils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, client *http.Client, req *http.Request) error
+}
+
+// Renewer is implemented by authenticators whose credentials expire. When a
+// request is answered with a 401 the credentials are renewed and the request
+// sent once more.
+type Renewer interface {
+	Renew(ctx context.Context, client *http.Client, req *http.Request) error
+}
+
+type BasicAuthenticator struct {
+	username, password string
+}
+
+func NewBasicAuthenticator(username, password string) *BasicAuthenticator {
+	return &BasicAuthenticator{username: username, password: password}
+}
+
+func (b *BasicAuthenticator) Authenticate(ctx context.Context, client *http.Client, req *http.Request) error {
+	req.SetBasicAuth(b.username, b.password)
+	return nil
+}
+
+// CookieAuthenticator logs in through the _session endpoint of the node the
+// request is sent to and reuses the AuthSession cookie until it expires.
+type CookieAuthenticator struct {
+	username, password string
+	mu                 sync.Mutex
+	cookie             *http.Cookie
+}
+
+func NewCookieAuthenticator(username, password string) *CookieAuthenticator {
+	return &CookieAuthenticator{username: username, password: password}
+}
+
+func (c *CookieAuthenticator) Authenticate(ctx context.Context, client *http.Client, req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cookie == nil {
+		if err := c.login(ctx, client, req); err != nil {
+			return err
+		}
+	}
+	req.AddCookie(c.cookie)
+	return nil
+}
+
+func (c *CookieAuthenticator) Renew(ctx context.Context, client *http.Client, req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.login(ctx, client, req)
+}
+
+func (c *CookieAuthenticator) login(ctx context.Context, client *http.Client, req *http.Request) error {
+	sessionURL := fmt.Sprintf("%s://%s/_session", req.URL.Scheme, net.JoinHostPort(req.URL.Hostname(), "5984"))
+	form := url.Values{"name": {c.username}, "password": {c.password}}
+
+	login, err := http.NewRequest("POST", sessionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(login.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return &ResponseError{StatusCode: resp.StatusCode, URL: sessionURL}
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "AuthSession" {
+			c.cookie = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+			return nil
+		}
+	}
+	return fmt.Errorf("No session cookie received from %s", sessionURL)
+}
+
+// JWTAuthenticator sends a bearer token read from a file or an environment
+// variable. The token is read again on renewal so rotated tokens are picked up.
+type JWTAuthenticator struct {
+	source func() (string, error)
+	mu     sync.Mutex
+	token  string
+}
+
+func NewJWTAuthenticatorFromFile(path string) *JWTAuthenticator {
+	return &JWTAuthenticator{source: func() (string, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}}
+}
+
+func NewJWTAuthenticatorFromEnv(name string) *JWTAuthenticator {
+	return &JWTAuthenticator{source: func() (string, error) {
+		token, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return token, nil
+	}}
+}
+
+func (j *JWTAuthenticator) Authenticate(ctx context.Context, client *http.Client, req *http.Request) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.token == "" {
+		if err := j.load(); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+j.token)
+	return nil
+}
+
+func (j *JWTAuthenticator) Renew(ctx context.Context, client *http.Client, req *http.Request) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.load()
+}
+
+func (j *JWTAuthenticator) load() error {
+	token, err := j.source()
+	if err != nil {
+		return err
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return fmt.Errorf("Empty JWT token")
+	}
+	j.token = token
+	return nil
+}
+
+// ProxyAuthenticator identifies requests with the X-Auth-CouchDB-* headers
+// used by CouchDB's proxy authentication. The token is only sent if a secret
+// is given.
+type ProxyAuthenticator struct {
+	username string
+	roles    []string
+	secret   string
+}
+
+func NewProxyAuthenticator(username string, roles []string, secret string) *ProxyAuthenticator {
+	return &ProxyAuthenticator{username: username, roles: roles, secret: secret}
+}
+
+func (p *ProxyAuthenticator) Authenticate(ctx context.Context, client *http.Client, req *http.Request) error {
+	req.Header.Set("X-Auth-CouchDB-UserName", p.username)
+	req.Header.Set("X-Auth-CouchDB-Roles", strings.Join(p.roles, ","))
+	if p.secret != "" {
+		mac := hmac.New(sha1.New, []byte(p.secret))
+		mac.Write([]byte(p.username))
+		req.Header.Set("X-Auth-CouchDB-Token", hex.EncodeToString(mac.Sum(nil)))
+	}
+	return nil
+}
@@ -1,33 +1,180 @@
 package httpUtils
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/sliceUtils"
 )
 
 type AuthenticatedHttpRequester struct {
-	server, username, password string
-	httpClient                 *http.Client
+	mu          sync.Mutex
+	servers     []string
+	current     int
+	nodeHosts   map[string]string
+	auth        Authenticator
+	httpClient  *http.Client
+	timeout     time.Duration
+	retryPolicy RetryPolicy
 }
 
-func NewAuthenticatedHttpRequester(username, password, server string) (ahr *AuthenticatedHttpRequester) {
+type ResponseError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("Received response %d for %s", e.StatusCode, e.URL)
+}
+
+func IsStatus(err error, statusCode int) bool {
+	respErr, ok := err.(*ResponseError)
+	return ok && respErr.StatusCode == statusCode
+}
+
+// NewAuthenticatedHttpRequester builds a requester for the given servers. The
+// first one is used until it cannot be reached, then the requester fails over
+// to the next.
+func NewAuthenticatedHttpRequester(username, password string, servers ...string) (ahr *AuthenticatedHttpRequester) {
 	ahr = &AuthenticatedHttpRequester{
-		server:   server,
-		username: username,
-		password: password,
-		httpClient: &http.Client{
-			Timeout: time.Second * 10,
-		},
+		servers:     servers,
+		auth:        NewBasicAuthenticator(username, password),
+		httpClient:  &http.Client{},
+		timeout:     time.Second * 10,
+		retryPolicy: DefaultRetryPolicy,
 	}
 	return
 }
 
-func (a *AuthenticatedHttpRequester) RunRequest(req *http.Request, dest interface{}) error {
-	req.SetBasicAuth(a.username, a.password)
+// SetTimeout bounds every attempt of the requests sent from now on. A zero
+// timeout leaves requests bounded only by the context they are run with.
+func (a *AuthenticatedHttpRequester) SetTimeout(timeout time.Duration) {
+	a.timeout = timeout
+}
+
+func (a *AuthenticatedHttpRequester) SetAuthenticator(auth Authenticator) {
+	a.auth = auth
+}
+
+func (a *AuthenticatedHttpRequester) SetRetryPolicy(policy RetryPolicy) {
+	a.retryPolicy = policy
+}
+
+// SetNodeHosts overrides the host each node is reached at, keyed by node name.
+// Nodes not in hosts are reached at the host part of their name.
+func (a *AuthenticatedHttpRequester) SetNodeHosts(hosts map[string]string) {
+	a.nodeHosts = hosts
+}
+
+// NodeHost returns the host the given node (e.g. couchdb@10.0.0.1) can be
+// reached at.
+func (a *AuthenticatedHttpRequester) NodeHost(node string) string {
+	host, ok := a.nodeHosts[node]
+	if !ok {
+		host = node[strings.Index(node, "@")+1:]
+	}
+	// IPv6 addresses are bracketed so that a port can be appended.
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return host
+}
+
+// RunRequest sends req and decodes the response into dest, retrying transient
+// failures as told by the retry policy. Reads are aborted as soon as ctx is
+// cancelled, but once a write is sent it is left to complete (bounded only by
+// deadlines) so that cancelling never leaves it half applied.
+func (a *AuthenticatedHttpRequester) RunRequest(ctx context.Context, req *http.Request, dest interface{}) error {
+	renewed := false
+	failovers := 0
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := a.runAttempt(ctx, req, dest)
+		if failovers < len(a.Servers())-1 && isConnectionError(err) && a.failover(req) {
+			if err = rewindBody(req); err != nil {
+				return err
+			}
+			failovers++
+			attempt--
+			continue
+		}
+		if renewer, ok := a.auth.(Renewer); ok && !renewed && IsStatus(err, http.StatusUnauthorized) {
+			log.WithField("URL", req.URL).Debug("Renewing credentials...")
+			if err = renewer.Renew(ctx, a.httpClient, req); err != nil {
+				return err
+			}
+			if err = rewindBody(req); err != nil {
+				return err
+			}
+			renewed = true
+			attempt--
+			continue
+		}
+		if !a.retryPolicy.shouldRetry(ctx, req, attempt, err) {
+			return err
+		}
+
+		backoff := a.retryPolicy.backoff(attempt)
+		log.WithFields(log.Fields{"URL": req.URL, "method": req.Method, "attempt": attempt, "backoff": backoff}).WithError(err).Debug("Retrying request...")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		if err = rewindBody(req); err != nil {
+			return err
+		}
+	}
+}
+
+func rewindBody(req *http.Request) (err error) {
+	if req.GetBody != nil {
+		req.Body, err = req.GetBody()
+	}
+	return
+}
+
+func (a *AuthenticatedHttpRequester) runAttempt(ctx context.Context, req *http.Request, dest interface{}) error {
+	var cancel context.CancelFunc
+	if req.Method != "GET" && req.Method != "HEAD" {
+		deadline, ok := ctx.Deadline()
+		ctx = context.Background()
+		if ok {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	if a.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	// Headers are copied so that credentials set on one attempt don't pile up
+	// on the next one.
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	req.Header = header
+
+	if err := a.auth.Authenticate(ctx, a.httpClient, req); err != nil {
+		return err
+	}
 
 	log.WithFields(log.Fields{"URL": req.URL, "method": req.Method}).Debug("Sending request...")
 
@@ -36,14 +183,14 @@ func (a *AuthenticatedHttpRequester) RunRequest(req *http.Request, dest interfac
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("Received response %d for %s", resp.StatusCode, req.URL.String())
+		return &ResponseError{StatusCode: resp.StatusCode, URL: req.URL.String()}
 	}
 
-	defer resp.Body.Close()
-
 	if dest != nil {
-		if err = json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		if err = json.NewDecoder(resp.Body).Decode(dest); err != nil && err != io.EOF {
 			return err
 		}
 	}
@@ -51,6 +198,99 @@ func (a *AuthenticatedHttpRequester) RunRequest(req *http.Request, dest interfac
 	return nil
 }
 
+// Server returns the server currently used to coordinate clustered requests.
 func (a *AuthenticatedHttpRequester) Server() string {
-	return a.server
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.servers[a.current]
+}
+
+func (a *AuthenticatedHttpRequester) Servers() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.servers...)
+}
+
+type nodeRequestKey struct{}
+
+// NewNodeRequest builds a request meant for the specific node it is addressed
+// to (see NodeHost). Unlike requests to Server(), it is never failed over.
+func NewNodeRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(context.WithValue(req.Context(), nodeRequestKey{}, true)), nil
+}
+
+// failover moves req to the next server when it was sent to the current
+// coordinator, whatever the port. Requests built with NewNodeRequest are never
+// moved as they target a specific node.
+func (a *AuthenticatedHttpRequester) failover(req *http.Request) bool {
+	if pinned, _ := req.Context().Value(nodeRequestKey{}).(bool); pinned {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	host, port := req.URL.Host, ""
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		host, port = host[:i], host[i:]
+	}
+	if !sliceUtils.Contains(a.servers, host) {
+		return false
+	}
+	if host == a.servers[a.current] {
+		a.current = (a.current + 1) % len(a.servers)
+	}
+	if host == a.servers[a.current] {
+		return false
+	}
+
+	log.WithFields(log.Fields{"from": host, "to": a.servers[a.current]}).Warn("Server unreachable, failing over...")
+	req.URL.Host = a.servers[a.current] + port
+	req.Host = ""
+	return true
+}
+
+// DiscoverServers adds the cluster's nodes, as listed by _membership, to the
+// servers that requests can fail over to.
+func (a *AuthenticatedHttpRequester) DiscoverServers(ctx context.Context) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_membership", a.Server()), nil)
+	if err != nil {
+		return err
+	}
+
+	var membership struct {
+		ClusterNodes []string `json:"cluster_nodes"`
+	}
+	if err = a.RunRequest(ctx, req, &membership); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, node := range membership.ClusterNodes {
+		host := a.NodeHost(node)
+		if !sliceUtils.Contains(a.servers, host) {
+			a.servers = append(a.servers, host)
+		}
+	}
+	return nil
+}
+
+// isConnectionError tells whether err means the server could not be reached at
+// all, so that the request is known not to have been processed.
+func isConnectionError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	switch e := err.(type) {
+	case *net.OpError:
+		return e.Op == "dial"
+	case *net.DNSError:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,81 @@
+package httpUtils
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent before giving up,
+	// including the first one. Values lower than 2 disable retries.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryableStatus lists the response codes worth sending the request again.
+	// Connection errors and timeouts are always retried.
+	RetryableStatus []int
+	// Requests other than GET, HEAD and OPTIONS are only retried when they
+	// could not reach the server at all, as sending them again could apply
+	// them twice or fail because of the first attempt. Setting this retries
+	// them like the others.
+	RetryNonIdempotent bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     3,
+	InitialBackoff:  200 * time.Millisecond,
+	MaxBackoff:      5 * time.Second,
+	RetryableStatus: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+}
+
+func (p RetryPolicy) shouldRetry(ctx context.Context, req *http.Request, attempt int, err error) bool {
+	if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if !p.RetryNonIdempotent {
+			return isConnectionError(err)
+		}
+	}
+
+	if respErr, ok := err.(*ResponseError); ok {
+		for _, status := range p.RetryableStatus {
+			if respErr.StatusCode == status {
+				return true
+			}
+		}
+		return false
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// backoff grows exponentially with each attempt and is jittered so that
+// several clients retrying at once do not hit the cluster in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff << uint(attempt-1)
+	if p.MaxBackoff > 0 && (backoff > p.MaxBackoff || backoff < p.InitialBackoff) {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
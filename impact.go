@@ -0,0 +1,245 @@
+package couchdb_admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/cabify/couchdb-admin/sliceUtils"
+)
+
+// Impact summarises what a destructive operation would change, so that it can
+// be reviewed before running it.
+type Impact struct {
+	Command   string
+	Target    string
+	Databases []DatabaseImpact
+	// Changes lists what the operation does besides removing replicas, one
+	// line each.
+	Changes []string
+}
+
+type DatabaseImpact struct {
+	Db     string
+	Ranges []RangeImpact
+	// MinReplicas is the lowest replica count of any of the database's ranges
+	// once the operation is applied.
+	MinReplicas int
+}
+
+type RangeImpact struct {
+	Range          string
+	ReplicasBefore int
+	ReplicasAfter  int
+}
+
+func (i *Impact) IsEmpty() bool {
+	return len(i.Databases) == 0 && len(i.Changes) == 0
+}
+
+// RemoveReplicaImpact tells how removing the replica of shard held by from
+// would change the database.
+func (db *Database) RemoveReplicaImpact(ctx context.Context, shard, from string, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	node, err := ParseNode(from)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.refreshDbConfig(ctx, ahr); err != nil {
+		return nil, err
+	}
+
+	impact := &Impact{Command: "remove_replica", Target: node.Addr()}
+	if dbImpact, affected := shardMapImpact(db.name, db.config, map[string][]string{shard: []string{node.Addr()}}); affected {
+		impact.Databases = append(impact.Databases, dbImpact)
+	}
+	return impact, nil
+}
+
+// RemoveNodeImpact tells which databases would lose replicas if node left the
+// cluster.
+func (cluster *Cluster) RemoveNodeImpact(ctx context.Context, node *Node, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := &Impact{Command: "remove_node", Target: node.Addr()}
+	for _, db_name := range dbs {
+		db, err := LoadDB(ctx, db_name, ahr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not access the %s database", db_name)
+		}
+
+		removals := make(map[string][]string)
+		for _, shard := range db.config.ByNode[node.Addr()] {
+			removals[shard] = []string{node.Addr()}
+		}
+		if dbImpact, affected := shardMapImpact(db_name, db.config, removals); affected {
+			impact.Databases = append(impact.Databases, dbImpact)
+		}
+	}
+	return impact, nil
+}
+
+func shardMapImpact(name string, config Config, removals map[string][]string) (DatabaseImpact, bool) {
+	dbImpact := DatabaseImpact{Db: name, MinReplicas: -1}
+
+	shards := make([]string, 0, len(config.ByRange))
+	for shard := range config.ByRange {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	for _, shard := range shards {
+		replicas := config.ByRange[shard]
+		after := len(replicas)
+		for _, node := range removals[shard] {
+			if sliceUtils.Contains(replicas, node) {
+				after--
+			}
+		}
+		if after != len(replicas) {
+			dbImpact.Ranges = append(dbImpact.Ranges, RangeImpact{Range: shard, ReplicasBefore: len(replicas), ReplicasAfter: after})
+		}
+		if dbImpact.MinReplicas < 0 || after < dbImpact.MinReplicas {
+			dbImpact.MinReplicas = after
+		}
+	}
+	return dbImpact, len(dbImpact.Ranges) > 0
+}
+
+// DeleteDatabaseImpact tells which ranges would lose every copy if the
+// database was deleted.
+func DeleteDatabaseImpact(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	db, err := LoadDB(ctx, name, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := &Impact{Command: "delete_db", Target: name}
+	if dbImpact, affected := shardMapImpact(name, db.config, db.config.ByRange); affected {
+		impact.Databases = append(impact.Databases, dbImpact)
+	}
+	return impact, nil
+}
+
+// RestoreImpact tells which replicas restoring the snapshot would remove and
+// add. If dbName is empty every database in the snapshot is considered.
+func (s *ShardMapSnapshot) RestoreImpact(ctx context.Context, dbName string, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	impact := &Impact{Command: "restore_shard_maps", Target: dbName}
+	names := []string{dbName}
+	if dbName == "" {
+		impact.Target = "all"
+		names = make([]string, 0, len(s.Databases))
+		for name := range s.Databases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		snapshot, exists := s.Databases[name]
+		if !exists {
+			return nil, fmt.Errorf("Database %s is not part of the snapshot!", name)
+		}
+		db, err := LoadDB(ctx, name, ahr)
+		if httpUtils.IsStatus(err, http.StatusNotFound) && dbName == "" {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not access the %s database", name)
+		}
+
+		additions, removals := shardMapChanges(db.config, snapshot)
+		if dbImpact, affected := shardMapImpact(name, db.config, removals); affected {
+			impact.Databases = append(impact.Databases, dbImpact)
+		}
+		shards := make([]string, 0, len(additions))
+		for shard := range additions {
+			shards = append(shards, shard)
+		}
+		sort.Strings(shards)
+		for _, shard := range shards {
+			for _, node := range additions[shard] {
+				impact.Changes = append(impact.Changes, fmt.Sprintf("add a replica of %s %s on %s", name, shard, node))
+			}
+		}
+	}
+	return impact, nil
+}
+
+// SetSecurityMatchingImpact tells which databases would have their security
+// object replaced by SetSecurityMatching.
+func SetSecurityMatchingImpact(ctx context.Context, filter DatabaseFilter, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	dbs, err := securityTargets(ctx, filter, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := &Impact{Command: "set_security", Target: filter.Glob}
+	if impact.Target == "" && filter.Regexp != nil {
+		impact.Target = filter.Regexp.String()
+	} else if impact.Target == "" {
+		impact.Target = "all"
+	}
+	for _, name := range dbs {
+		impact.Changes = append(impact.Changes, fmt.Sprintf("replace the security object of %s", name))
+	}
+	return impact, nil
+}
+
+// SyncIndexesImpact tells which indexes syncing the declared ones with prune
+// would delete.
+func (db *Database) SyncIndexesImpact(ctx context.Context, declared []IndexDefinition, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	report, err := db.SyncIndexes(ctx, declared, true, true, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := &Impact{Command: "sync_indexes", Target: db.name}
+	for _, index := range report.Deleted {
+		impact.Changes = append(impact.Changes, fmt.Sprintf("delete index %s", index.String()))
+	}
+	return impact, nil
+}
+
+// DeleteUserImpact tells what deleting the user from _users would remove.
+func DeleteUserImpact(name string) *Impact {
+	return &Impact{Command: "delete_user", Target: name, Changes: []string{fmt.Sprintf("delete user %s from _users", name)}}
+}
+
+// DeleteAdminImpact tells what deleting the server admin would remove.
+func (cluster *Cluster) DeleteAdminImpact(name string) *Impact {
+	impact := &Impact{Command: "delete_admin", Target: name}
+	for _, node := range cluster.NodesInfo.ClusterNodes {
+		impact.Changes = append(impact.Changes, fmt.Sprintf("delete server admin %s from %s", name, node))
+	}
+	return impact
+}
+
+// DeleteReplicationImpact tells which replication deleting id would stop.
+func DeleteReplicationImpact(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) (*Impact, error) {
+	rep, err := LoadReplication(ctx, id, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	change := fmt.Sprintf("stop replicating %s to %s", rep.Source.String(), rep.Target.String())
+	if rep.Continuous {
+		change += " continuously"
+	}
+	return &Impact{Command: "delete_replication", Target: id, Changes: []string{change}}, nil
+}
+
+// UndoImpact tells which journaled operation undoing id would revert.
+func UndoImpact(ctx context.Context, id string) (*Impact, error) {
+	rec, err := FindJournalRecord(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	change := fmt.Sprintf("revert %s on %s, applied by %s at %s", rec.Command, rec.Target, rec.Operator, rec.Timestamp.Format(time.RFC3339))
+	return &Impact{Command: "undo", Target: id, Changes: []string{change}}, nil
+}
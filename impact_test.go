@@ -0,0 +1,125 @@
+package couchdb_admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+const impactTestDbConfig = `{
+	"_id": "testdb",
+	"_rev": "2-5e2d10c29c70d3869fb7a1fd3a827a64",
+	"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+	"changelog": [],
+	"by_node": {
+		"couchdb@127.0.0.1": [ "00000000-7fffffff", "80000000-ffffffff" ],
+		"couchdb@127.0.0.2": [ "00000000-7fffffff", "80000000-ffffffff" ],
+		"couchdb@127.0.0.3": [ "00000000-7fffffff" ]
+	},
+	"by_range": {
+		"00000000-7fffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"],
+		"80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]
+	}}`
+
+func TestRemoveReplicaImpactSummarisesDroppedReplicas(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, impactTestDbConfig))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	impact, err := db.RemoveReplicaImpact(context.Background(), "80000000-ffffffff", "127.0.0.2", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, impact, &Impact{
+		Command: "remove_replica",
+		Target:  "couchdb@127.0.0.2",
+		Databases: []DatabaseImpact{{
+			Db:          "testdb",
+			Ranges:      []RangeImpact{{Range: "80000000-ffffffff", ReplicasBefore: 2, ReplicasAfter: 1}},
+			MinReplicas: 1,
+		}},
+	})
+}
+
+func TestRemoveNodeImpactListsEveryAffectedRange(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["testdb"]`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, impactTestDbConfig))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	cluster := &Cluster{}
+
+	node, err := ParseNode("127.0.0.3")
+	if err != nil {
+		t.Error(err)
+	}
+	impact, err := cluster.RemoveNodeImpact(context.Background(), node, ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, impact.Databases, []DatabaseImpact{{
+		Db:          "testdb",
+		Ranges:      []RangeImpact{{Range: "00000000-7fffffff", ReplicasBefore: 3, ReplicasAfter: 2}},
+		MinReplicas: 2,
+	}})
+
+	node, err = ParseNode("127.0.0.4")
+	if err != nil {
+		t.Error(err)
+	}
+	impact, err = cluster.RemoveNodeImpact(context.Background(), node, ahr)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.True(t, impact.IsEmpty())
+}
+
+func TestRestoreImpactListsRemovedAndAddedReplicas(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, impactTestDbConfig))
+
+	snapshot := &ShardMapSnapshot{Databases: map[string]Config{
+		"testdb": Config{ByRange: map[string][]string{
+			"00000000-7fffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+			"80000000-ffffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"},
+		}},
+	}}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	impact, err := snapshot.RestoreImpact(context.Background(), "", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, impact, &Impact{
+		Command: "restore_shard_maps",
+		Target:  "all",
+		Databases: []DatabaseImpact{{
+			Db:          "testdb",
+			Ranges:      []RangeImpact{{Range: "00000000-7fffffff", ReplicasBefore: 3, ReplicasAfter: 2}},
+			MinReplicas: 2,
+		}},
+		Changes: []string{"add a replica of testdb 80000000-ffffffff on couchdb@127.0.0.3"},
+	})
+}
@@ -0,0 +1,260 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// Index is a Mango index as listed by /{db}/_index.
+type Index struct {
+	Ddoc string          `json:"ddoc"`
+	Name string          `json:"name"`
+	Type string          `json:"type"`
+	Def  json.RawMessage `json:"def"`
+}
+
+// IndexDefinition is the body POSTed to /{db}/_index to create an index.
+type IndexDefinition struct {
+	Index json.RawMessage `json:"index"`
+	Ddoc  string          `json:"ddoc,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Type  string          `json:"type,omitempty"`
+}
+
+// IndexSyncReport tells what syncing a database's indexes changed or would
+// change.
+type IndexSyncReport struct {
+	Created []IndexDefinition
+	// Unused are the indexes in the database that are not declared. They are
+	// only deleted when pruning.
+	Unused     []Index
+	Deleted    []Index
+	Duplicates [][]Index
+}
+
+func (i *Index) String() string {
+	return fmt.Sprintf("%s/%s", i.Ddoc, i.Name)
+}
+
+// LoadIndexDefinitions reads a JSON array of index definitions.
+func LoadIndexDefinitions(r io.Reader) ([]IndexDefinition, error) {
+	var defs []IndexDefinition
+	if err := json.NewDecoder(r).Decode(&defs); err != nil {
+		return nil, err
+	}
+	for _, def := range defs {
+		if len(def.Index) == 0 {
+			return nil, fmt.Errorf("Index definition %s has no index field!", def.Name)
+		}
+	}
+	return defs, nil
+}
+
+// Indexes returns the Mango indexes of the database, leaving out the special
+// _all_docs one.
+func (db *Database) Indexes(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]Index, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_index", ahr.Server(), db.name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Indexes []Index `json:"indexes"`
+	}
+	if err = ahr.RunRequest(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]Index, 0, len(resp.Indexes))
+	for _, index := range resp.Indexes {
+		if index.Type != "special" {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+func (db *Database) CreateIndex(ctx context.Context, def IndexDefinition, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "create_index", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	b, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:5984/%s/_index", ahr.Server(), db.name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var result struct {
+		Id     string `json:"id"`
+		Name   string `json:"name"`
+		Result string `json:"result"`
+	}
+	if err = ahr.RunRequest(ctx, req, &result); err != nil {
+		return err
+	}
+	if result.Result == "exists" {
+		log.WithFields(log.Fields{"db": db.name, "ddoc": result.Id, "name": result.Name}).Debug("Index already exists")
+		return nil
+	}
+	return record(ctx, "create_index", db.name, nil, def)
+}
+
+// DeleteIndex deletes an index given its design document, with or without the
+// _design/ prefix, and name.
+func (db *Database) DeleteIndex(ctx context.Context, ddoc, name string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "delete_index", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	indexes, err := db.Indexes(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	ddoc = "_design/" + strings.TrimPrefix(ddoc, "_design/")
+	var index *Index
+	for i := range indexes {
+		if indexes[i].Ddoc == ddoc && indexes[i].Name == name {
+			index = &indexes[i]
+		}
+	}
+	if index == nil {
+		return fmt.Errorf("Index %s/%s does not exist in %s!", ddoc, name, db.name)
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/%s/_index/%s/%s/%s", ahr.Server(), db.name, strings.TrimPrefix(ddoc, "_design/"), index.Type, name), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "delete_index", db.name, index, nil)
+}
+
+// SyncIndexes creates the declared indexes missing in the database and
+// reports the ones that are not declared, deleting them if prune is set.
+// Indexes are matched by their type and definition, not by their name. With
+// dryRun nothing is changed.
+func (db *Database) SyncIndexes(ctx context.Context, declared []IndexDefinition, prune, dryRun bool, ahr *httpUtils.AuthenticatedHttpRequester) (*IndexSyncReport, error) {
+	ctx, release, err := acquireLock(ctx, "sync_indexes", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	wanted := make(map[string]bool, len(declared))
+	for _, def := range declared {
+		key, err := indexKey(def.Type, def.Index)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid index definition %s: %s", def.Name, err)
+		}
+		if wanted[key] {
+			return nil, fmt.Errorf("Index %s is declared twice!", key)
+		}
+		wanted[key] = true
+	}
+
+	indexes, err := db.Indexes(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IndexSyncReport{}
+	existing := make(map[string][]Index)
+	var keys []string
+	for _, index := range indexes {
+		key, err := indexKey(index.Type, index.Def)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid index %s: %s", index.String(), err)
+		}
+		if _, seen := existing[key]; !seen {
+			keys = append(keys, key)
+		}
+		existing[key] = append(existing[key], index)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(existing[key]) > 1 {
+			report.Duplicates = append(report.Duplicates, existing[key])
+		}
+		if !wanted[key] {
+			report.Unused = append(report.Unused, existing[key]...)
+		}
+	}
+
+	for _, def := range declared {
+		key, _ := indexKey(def.Type, def.Index)
+		if _, exists := existing[key]; exists {
+			continue
+		}
+		if !dryRun {
+			log.WithFields(log.Fields{"db": db.name, "index": key}).Debug("Creating index...")
+			if err = db.CreateIndex(ctx, def, ahr); err != nil {
+				return report, err
+			}
+		}
+		report.Created = append(report.Created, def)
+	}
+
+	if !prune {
+		return report, nil
+	}
+	for _, index := range report.Unused {
+		if !dryRun {
+			log.WithFields(log.Fields{"db": db.name, "index": index.String()}).Debug("Deleting index...")
+			if err = db.DeleteIndex(ctx, index.Ddoc, index.Name, ahr); err != nil {
+				return report, err
+			}
+		}
+		report.Deleted = append(report.Deleted, index)
+	}
+	return report, nil
+}
+
+// indexKey identifies an index by its type and definition. Fields given as
+// bare names are sorted ascending, as CouchDB stores them, and empty partial
+// filter selectors are ignored.
+func indexKey(indexType string, def json.RawMessage) (string, error) {
+	if indexType == "" {
+		indexType = "json"
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(def, &parsed); err != nil {
+		return "", err
+	}
+	if fields, ok := parsed["fields"].([]interface{}); ok {
+		for i, field := range fields {
+			if name, ok := field.(string); ok {
+				fields[i] = map[string]interface{}{name: "asc"}
+			}
+		}
+	}
+	if selector, ok := parsed["partial_filter_selector"].(map[string]interface{}); ok && len(selector) == 0 {
+		delete(parsed, "partial_filter_selector")
+	}
+
+	b, err := json.Marshal(parsed)
+	if err != nil {
+		return "", err
+	}
+	return indexType + ":" + string(b), nil
+}
@@ -0,0 +1,88 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestSyncIndexesCreatesMissingAndPrunesUnused(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb/_index",
+		httpmock.NewStringResponder(200, `{"total_rows": 5, "indexes": [
+			{"ddoc": null, "name": "_all_docs", "type": "special", "def": {"fields": [{"_id": "asc"}]}},
+			{"ddoc": "_design/by-email", "name": "by-email", "type": "json", "def": {"fields": [{"email": "asc"}], "partial_filter_selector": {}}},
+			{"ddoc": "_design/a1b2", "name": "a1b2", "type": "json", "def": {"fields": [{"email": "asc"}]}},
+			{"ddoc": "_design/legacy", "name": "by-type", "type": "json", "def": {"fields": [{"type": "asc"}]}}]}`))
+
+	var created []IndexDefinition
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/testdb/_index",
+		func(req *http.Request) (*http.Response, error) {
+			var def IndexDefinition
+			b, _ := ioutil.ReadAll(req.Body)
+			if err := json.Unmarshal(b, &def); err != nil {
+				return nil, err
+			}
+			created = append(created, def)
+			return httpmock.NewStringResponse(200, `{"result": "created", "id": "_design/by-date", "name": "by-date"}`), nil
+		})
+
+	deleted := false
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/testdb/_index/legacy/json/by-type",
+		func(req *http.Request) (*http.Response, error) {
+			deleted = true
+			return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+		})
+
+	declared, err := LoadIndexDefinitions(strings.NewReader(`[
+		{"index": {"fields": ["email"]}, "name": "by-email"},
+		{"index": {"fields": ["created_at"]}, "ddoc": "by-date", "name": "by-date"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &Database{name: "testdb"}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	report, err := db.SyncIndexes(context.Background(), declared, true, false, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, created, 1)
+	assert.Equal(t, created[0].Name, "by-date")
+	assert.Len(t, report.Created, 1)
+	assert.Equal(t, report.Created[0].Name, "by-date")
+	assert.True(t, deleted)
+	assert.Len(t, report.Deleted, 1)
+	assert.Equal(t, report.Deleted[0].String(), "_design/legacy/by-type")
+	assert.Len(t, report.Duplicates, 1)
+	assert.Len(t, report.Duplicates[0], 2)
+}
+
+func TestSyncIndexesRefusesDuplicatedDeclarations(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	declared, err := LoadIndexDefinitions(strings.NewReader(`[
+		{"index": {"fields": ["email"]}},
+		{"index": {"fields": [{"email": "asc"}]}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &Database{name: "testdb"}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	_, err = db.SyncIndexes(context.Background(), declared, false, true, ahr)
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package couchdb_admin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+type JournalRecord struct {
+	Id        string          `json:"_id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Operator  string          `json:"operator"`
+	Command   string          `json:"command"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+type Journal interface {
+	Append(ctx context.Context, record *JournalRecord) error
+	Records(ctx context.Context) ([]JournalRecord, error)
+}
+
+// databaseJournal is implemented by journals kept in a database of the
+// cluster, which must not be deleted.
+type databaseJournal interface {
+	Database() string
+}
+
+var (
+	journal         Journal
+	journalOperator string
+)
+
+// SetJournal makes every mutating operation append a record to j. Passing a
+// nil journal disables journaling, which is the default.
+func SetJournal(j Journal, operator string) {
+	journal = j
+	journalOperator = operator
+}
+
+// record appends the operation to the journal, if any. Its error tells the
+// caller that the operation was applied but left no trace to undo it from.
+func record(ctx context.Context, command, target string, before, after interface{}) error {
+	if journal == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	rec := &JournalRecord{
+		Id:        strconv.FormatInt(now.UnixNano(), 36),
+		Timestamp: now,
+		Operator:  journalOperator,
+		Command:   command,
+		Target:    target,
+	}
+
+	var err error
+	if rec.Before, err = toRawJSON(before); err == nil {
+		rec.After, err = toRawJSON(after)
+	}
+	if err == nil {
+		err = journal.Append(ctx, rec)
+	}
+	if err != nil {
+		return fmt.Errorf("%s on %s was applied but could not be journaled: %s", command, target, err)
+	}
+	return nil
+}
+
+func toRawJSON(v interface{}) (json.RawMessage, error) {
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		return value, nil
+	default:
+		return json.Marshal(value)
+	}
+}
+
+func FindJournalRecord(ctx context.Context, id string) (*JournalRecord, error) {
+	if journal == nil {
+		return nil, fmt.Errorf("No journal configured!")
+	}
+
+	records, err := journal.Records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].Id == id {
+			return &records[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Journal record %s not found", id)
+}
+
+func JournalRecords(ctx context.Context) ([]JournalRecord, error) {
+	if journal == nil {
+		return nil, fmt.Errorf("No journal configured!")
+	}
+	return journal.Records(ctx)
+}
+
+type FileJournal struct {
+	path string
+}
+
+func NewFileJournal(path string) *FileJournal {
+	return &FileJournal{path: path}
+}
+
+func (j *FileJournal) Append(ctx context.Context, rec *JournalRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (j *FileJournal) Records(ctx context.Context) ([]JournalRecord, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []JournalRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec JournalRecord
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+type DatabaseJournal struct {
+	name string
+	ahr  *httpUtils.AuthenticatedHttpRequester
+}
+
+func NewDatabaseJournal(name string, ahr *httpUtils.AuthenticatedHttpRequester) *DatabaseJournal {
+	return &DatabaseJournal{name: name, ahr: ahr}
+}
+
+// Database returns the name of the database records are kept in.
+func (j *DatabaseJournal) Database() string {
+	return j.name
+}
+
+func (j *DatabaseJournal) Append(ctx context.Context, rec *JournalRecord) error {
+	if err := ensureDatabase(ctx, j.name, j.ahr); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s/%s", j.ahr.Server(), j.name, rec.Id), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return j.ahr.RunRequest(ctx, req, nil)
+}
+
+func (j *DatabaseJournal) Records(ctx context.Context) ([]JournalRecord, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_all_docs?include_docs=true", j.ahr.Server(), j.name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Doc JournalRecord `json:"doc"`
+		} `json:"rows"`
+	}
+	if err = j.ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	records := make([]JournalRecord, 0, len(docs.Rows))
+	for _, row := range docs.Rows {
+		records = append(records, row.Doc)
+	}
+	return records, nil
+}
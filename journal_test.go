@@ -0,0 +1,230 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func tempJournal(t *testing.T) (*FileJournal, func()) {
+	f, err := ioutil.TempFile("", "couchdb-admin-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	j := NewFileJournal(f.Name())
+	SetJournal(j, "tester")
+	return j, func() {
+		SetJournal(nil, "")
+		os.Remove(f.Name())
+	}
+}
+
+func TestFileJournalKeepsRecords(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	record(context.Background(), "set_config", "couchdb@127.0.0.1", configValue{"log", "level", "info", true}, configValue{"log", "level", "debug", true})
+	record(context.Background(), "remove_node", "couchdb@127.0.0.2", map[string]string{"_id": "couchdb@127.0.0.2"}, nil)
+
+	records, err := j.Records(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Len(t, records, 2)
+	assert.Equal(t, records[0].Operator, "tester")
+	assert.Equal(t, records[0].Command, "set_config")
+	assert.Equal(t, records[0].Target, "couchdb@127.0.0.1")
+	assert.JSONEq(t, string(records[0].Before), `{"section": "log", "key": "level", "value": "info", "existed": true}`)
+	assert.JSONEq(t, string(records[0].After), `{"section": "log", "key": "level", "value": "debug", "existed": true}`)
+	assert.Equal(t, records[1].Command, "remove_node")
+	assert.Nil(t, records[1].After)
+
+	rec, err := FindJournalRecord(context.Background(), records[1].Id)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, rec.Target, "couchdb@127.0.0.2")
+}
+
+func TestRecordFailsWhenTheJournalCantBeWritten(t *testing.T) {
+	SetJournal(NewFileJournal(filepath.Join(os.TempDir(), "missing", "dir", "journal")), "tester")
+	defer SetJournal(nil, "")
+
+	assert.Error(t, record(context.Background(), "set_config", "couchdb@127.0.0.1", nil, configValue{"log", "level", "debug", true}))
+}
+
+func TestUndoRevertsRemovedReplica(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+	mockLocks()
+	mockZones(nil)
+
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": ["00000000-ffffffff"],
+				"couchdb@127.0.0.2": ["00000000-ffffffff"]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]
+			}
+		}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, ""))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr); err != nil {
+		t.Error(err)
+	}
+
+	records, err := j.Records(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Len(t, records, 1)
+	assert.Equal(t, records[0].Command, "remove_replica")
+	assert.Equal(t, records[0].Target, "testdb")
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "2-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": ["00000000-ffffffff"]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1"]
+			}
+		}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"],
+	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
+		httpmock.NewStringResponder(200, `"false"`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
+		httpmock.NewStringResponder(200, `"false"`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_dbs/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			body := Config{}
+
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+
+			assert.Equal(t, body.Rev, "2-5e2d10c29c70d3869fb7a1fd3a827a64")
+			assert.Equal(t, body.ByRange, map[string][]string{
+				"00000000-ffffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+			})
+
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	if err = Undo(context.Background(), records[0].Id, ahr); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUndoRefusesIfShardMapChanged(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	_, cleanup := tempJournal(t)
+	defer cleanup()
+
+	before := Config{Id: "testdb", ByRange: map[string][]string{"00000000-ffffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"}}}
+	after := Config{Id: "testdb", ByRange: map[string][]string{"00000000-ffffffff": []string{"couchdb@127.0.0.1"}}}
+	record(context.Background(), "remove_replica", "testdb", before, after)
+
+	records, err := JournalRecords(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "3-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.3": ["00000000-ffffffff"]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.3"]
+			}
+		}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	err = Undo(context.Background(), records[0].Id, ahr)
+	assert.Error(t, err, "Undo should have been rejected as the shard map changed since the operation")
+}
+
+func TestUndoConfigChangeRestoresEmptyValues(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	_, cleanup := tempJournal(t)
+	defer cleanup()
+
+	record(context.Background(), "set_config", "couchdb@127.0.0.1", configValue{"log", "file", "", true}, configValue{"log", "file", "/var/log/couchdb.log", true})
+	records, err := JournalRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/file",
+		httpmock.NewStringResponder(200, `"/var/log/couchdb.log"`))
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/file",
+		func(req *http.Request) (*http.Response, error) {
+			t.Error("A key that existed with an empty value should not be deleted")
+			return httpmock.NewStringResponse(200, `"/var/log/couchdb.log"`), nil
+		})
+	var restored string
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/file",
+		func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			restored = string(b)
+			return httpmock.NewStringResponse(200, `"/var/log/couchdb.log"`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err = Undo(context.Background(), records[0].Id, ahr); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, restored, `""`)
+}
@@ -0,0 +1,214 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/cabify/couchdb-admin/sliceUtils"
+)
+
+// Layout maps each shard range to the nodes holding a copy of it, as in the
+// by_range section of a database's _dbs document.
+type Layout map[string][]string
+
+const ringTop int64 = 1 << 32
+
+// ShardRanges returns the ranges CouchDB splits a database with the given
+// number of shards into.
+func ShardRanges(shards int) []string {
+	var ranges []string
+	increment := ringTop / int64(shards)
+	for start := int64(0); start < ringTop; {
+		end := start + increment - 1
+		if start+2*increment > ringTop {
+			end = ringTop - 1
+		}
+		ranges = append(ranges, fmt.Sprintf("%08x-%08x", start, end))
+		start = end + 1
+	}
+	return ranges
+}
+
+// LayoutOnNodes spreads the ranges of a database with the given number of
+// shards over the given nodes, giving each range replicas copies on
+// consecutive nodes. A replicas of 0, or not lower than the number of nodes,
+// places every range on all of them.
+func LayoutOnNodes(nodes []string, shards, replicas int) Layout {
+	layout := make(Layout, shards)
+	for i, shard := range ShardRanges(shards) {
+		if replicas <= 0 || replicas >= len(nodes) {
+			layout[shard] = append([]string(nil), nodes...)
+			continue
+		}
+		for j := 0; j < replicas; j++ {
+			layout[shard] = append(layout[shard], nodes[(i+j)%len(nodes)])
+		}
+	}
+	return layout
+}
+
+// LoadLayout reads a layout in the same format as the by_range section of a
+// _dbs document: {"by_range": {"00000000-7fffffff": ["couchdb@..."], ...}}.
+func LoadLayout(r io.Reader) (Layout, error) {
+	var doc struct {
+		ByRange Layout `json:"by_range"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.ByRange) == 0 {
+		return nil, fmt.Errorf("Layout does not contain any range!")
+	}
+	return doc.ByRange, nil
+}
+
+// LayoutOf returns the current layout of an existing database.
+func LayoutOf(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (Layout, error) {
+	db, err := LoadDB(ctx, name, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := make(Layout, len(db.config.ByRange))
+	for shard, nodes := range db.config.ByRange {
+		layout[shard] = append([]string(nil), nodes...)
+	}
+	return layout, nil
+}
+
+// CreateDatabaseWithLayout creates a database and pins each of its ranges to
+// the nodes given by layout.
+func CreateDatabaseWithLayout(ctx context.Context, name string, layout Layout, ahr *httpUtils.AuthenticatedHttpRequester) (*Database, error) {
+	layout, err := layout.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, release, err := acquireLock(ctx, "create_db", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+	replicas := 0
+	for _, nodes := range layout {
+		for _, node := range nodes {
+			if !cluster.IsNodeUpAndJoined(node) {
+				return nil, fmt.Errorf("%s is not part of the cluster!", node)
+			}
+		}
+		if len(nodes) > replicas {
+			replicas = len(nodes)
+		}
+	}
+
+	db, err := createDatabase(ctx, name, fmt.Sprintf("n=%d&q=%d", replicas, len(layout)), ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := json.Marshal(db.config)
+	if err != nil {
+		return nil, err
+	}
+	db.applyLayout(layout)
+
+	if err = db.saveConfig(ctx, "set_layout", before, ahr); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// normalize checks that the layout's ranges cover the whole keyspace without
+// gaps nor overlaps, as they do once some have been split, and that every
+// range has copies, turning bare hosts into node names.
+func (l Layout) normalize() (Layout, error) {
+	if len(l) == 0 {
+		return nil, fmt.Errorf("Layout does not contain any range!")
+	}
+
+	shards := make([]string, 0, len(l))
+	for shard := range l {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	normalized := make(Layout, len(l))
+	var next int64
+	for _, shard := range shards {
+		begin, end, err := parseRange(shard)
+		if err != nil {
+			return nil, err
+		}
+		if begin > next {
+			return nil, fmt.Errorf("Layout does not cover %08x-%08x!", next, begin-1)
+		}
+		if begin < next {
+			return nil, fmt.Errorf("Range %s overlaps the previous one!", shard)
+		}
+		next = end + 1
+
+		nodes := l[shard]
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("Range %s is not placed on any node!", shard)
+		}
+		for _, n := range nodes {
+			node, err := ParseNode(n)
+			if err != nil {
+				return nil, err
+			}
+			if sliceUtils.Contains(normalized[shard], node.Addr()) {
+				return nil, fmt.Errorf("%s is given twice for range %s!", node.Addr(), shard)
+			}
+			normalized[shard] = append(normalized[shard], node.Addr())
+		}
+	}
+	if next != ringTop {
+		return nil, fmt.Errorf("Layout does not cover %08x-%08x!", next, ringTop-1)
+	}
+	return normalized, nil
+}
+
+// parseRange returns the bounds of a range written as CouchDB does, e.g.
+// 00000000-7fffffff.
+func parseRange(shardRange string) (int64, int64, error) {
+	bounds := strings.SplitN(shardRange, "-", 2)
+	if len(bounds) != 2 || len(bounds[0]) != 8 || len(bounds[1]) != 8 {
+		return 0, 0, fmt.Errorf("%s is not a shard range!", shardRange)
+	}
+	begin, err := strconv.ParseInt(bounds[0], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is not a shard range!", shardRange)
+	}
+	end, err := strconv.ParseInt(bounds[1], 16, 64)
+	if err != nil || end < begin || fmt.Sprintf("%08x-%08x", begin, end) != shardRange {
+		return 0, 0, fmt.Errorf("%s is not a shard range!", shardRange)
+	}
+	return begin, end, nil
+}
+
+func (db *Database) applyLayout(layout Layout) {
+	shards := make([]string, 0, len(layout))
+	for shard := range layout {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	db.config.ByRange = make(map[string][]string, len(layout))
+	db.config.ByNode = make(map[string][]string)
+	for _, shard := range shards {
+		for _, node := range layout[shard] {
+			db.addReplica(shard, node)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestShardRangesMatchCouchDB(t *testing.T) {
+	assert.Equal(t, ShardRanges(1), []string{"00000000-ffffffff"})
+	assert.Equal(t, ShardRanges(2), []string{"00000000-7fffffff", "80000000-ffffffff"})
+	assert.Equal(t, ShardRanges(3), []string{"00000000-55555554", "55555555-aaaaaaa9", "aaaaaaaa-ffffffff"})
+	assert.Len(t, ShardRanges(8), 8)
+}
+
+func TestLayoutOnNodesSpreadsReplicas(t *testing.T) {
+	nodes := []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"}
+
+	assert.Equal(t, Layout{
+		"00000000-55555554": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+		"55555555-aaaaaaa9": []string{"couchdb@127.0.0.2", "couchdb@127.0.0.3"},
+		"aaaaaaaa-ffffffff": []string{"couchdb@127.0.0.3", "couchdb@127.0.0.1"},
+	}, LayoutOnNodes(nodes, 3, 2))
+
+	assert.Equal(t, Layout{
+		"00000000-7fffffff": nodes,
+		"80000000-ffffffff": nodes,
+	}, LayoutOnNodes(nodes, 2, 0))
+}
+
+func TestCreateDatabaseWithLayoutRewritesShardMap(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"],
+	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"]}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/testdb?n=2&q=2",
+		httpmock.NewStringResponder(201, `{"ok": true}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": [ "00000000-7fffffff", "80000000-ffffffff" ],
+				"couchdb@127.0.0.3": [ "00000000-7fffffff", "80000000-ffffffff" ]
+			},
+			"by_range": {
+				"00000000-7fffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.3"],
+				"80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.3"]
+			}}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_dbs/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			body := Config{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+
+			assert.Equal(t, body.Rev, "1-5e2d10c29c70d3869fb7a1fd3a827a64")
+			assert.Equal(t, body.ByNode, map[string][]string{
+				"couchdb@127.0.0.1": []string{"00000000-7fffffff"},
+				"couchdb@127.0.0.2": []string{"00000000-7fffffff", "80000000-ffffffff"},
+			})
+			assert.Equal(t, body.ByRange, map[string][]string{
+				"00000000-7fffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+				"80000000-ffffffff": []string{"couchdb@127.0.0.2"},
+			})
+			return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+		})
+
+	layout, err := LoadLayout(strings.NewReader(`{"by_range": {
+		"00000000-7fffffff": ["127.0.0.1", "couchdb@127.0.0.2"],
+		"80000000-ffffffff": ["127.0.0.2"]}}`))
+	if err != nil {
+		t.Error(err)
+	}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if _, err = CreateDatabaseWithLayout(context.Background(), "testdb", layout, ahr); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateDatabaseWithLayoutRejectsInvalidLayouts(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	for _, layout := range []Layout{
+		Layout{"00000000-7fffffff": []string{"127.0.0.1"}, "80000000-fffffffe": []string{"127.0.0.1"}},
+		Layout{"00000000-7fffffff": []string{"127.0.0.1"}, "90000000-ffffffff": []string{"127.0.0.1"}},
+		Layout{"00000000-7fffffff": []string{"127.0.0.1"}, "00000000-3fffffff": []string{"127.0.0.1"}, "80000000-ffffffff": []string{"127.0.0.1"}},
+		Layout{"0-ffffffff": []string{"127.0.0.1"}},
+		Layout{"00000000-ffffffff": []string{}},
+		Layout{"00000000-ffffffff": []string{"127.0.0.1", "couchdb@127.0.0.1"}},
+		Layout{"00000000-ffffffff": []string{"127.0.0.9"}},
+	} {
+		_, err := CreateDatabaseWithLayout(context.Background(), "testdb", layout, ahr)
+		assert.Error(t, err, "%v", layout)
+	}
+}
+
+func TestLayoutAcceptsSplitRanges(t *testing.T) {
+	layout, err := Layout{
+		"00000000-3fffffff": []string{"127.0.0.1"},
+		"40000000-7fffffff": []string{"127.0.0.1"},
+		"80000000-ffffffff": []string{"127.0.0.2"},
+	}.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, layout["80000000-ffffffff"], []string{"couchdb@127.0.0.2"})
+}
@@ -0,0 +1,261 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// CouchDB only allows system databases to start with an underscore.
+const LocksDb = "couchdb_admin_locks"
+
+const clusterLockId = "cluster"
+
+type Lease struct {
+	Id         string    `json:"_id"`
+	Rev        string    `json:"_rev,omitempty"`
+	Holder     string    `json:"holder"`
+	Command    string    `json:"command"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (l *Lease) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+var (
+	lockHolder = defaultLockHolder()
+	lockTTL    = time.Minute
+	lockState  struct {
+		sync.Mutex
+		lease *Lease
+		depth int
+		// stop tells the renewer to exit, which it acknowledges by closing
+		// done. lost is closed by the renewer when the lease can't be renewed.
+		stop, done, lost chan struct{}
+	}
+)
+
+func defaultLockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s:%d", os.Getenv("USER"), host, os.Getpid())
+}
+
+// SetLockHolder sets the identity written into the leases this process takes
+// and how long they last unless renewed.
+func SetLockHolder(holder string, ttl time.Duration) {
+	lockHolder = holder
+	lockTTL = ttl
+}
+
+// acquireLock takes the cluster-wide lease before a mutating operation and
+// keeps renewing it until the returned release function is called. Nested
+// operations reuse the lease already held by this process. The returned
+// context is cancelled if the lease can't be renewed, so that the operation
+// is aborted rather than carried on without the lock.
+func acquireLock(ctx context.Context, command string, ahr *httpUtils.AuthenticatedHttpRequester) (context.Context, func(), error) {
+	lockState.Lock()
+	defer lockState.Unlock()
+
+	if lockState.lease == nil {
+		lease, err := takeLease(ctx, command, ahr)
+		if err != nil {
+			return ctx, nil, err
+		}
+		log.WithFields(log.Fields{"holder": lease.Holder, "command": command}).Debug("Cluster lock acquired")
+
+		lockState.lease = lease
+		lockState.stop = make(chan struct{})
+		lockState.done = make(chan struct{})
+		lockState.lost = make(chan struct{})
+		go renewLease(ctx, lease, lockState.stop, lockState.done, lockState.lost, ahr)
+	}
+	lockState.depth++
+
+	opCtx, cancel := context.WithCancel(ctx)
+	go func(lost chan struct{}) {
+		select {
+		case <-lost:
+			cancel()
+		case <-opCtx.Done():
+		}
+	}(lockState.lost)
+
+	return opCtx, func() {
+		cancel()
+		releaseLock(ahr)
+	}, nil
+}
+
+func releaseLock(ahr *httpUtils.AuthenticatedHttpRequester) {
+	lockState.Lock()
+	lockState.depth--
+	if lockState.depth > 0 {
+		lockState.Unlock()
+		return
+	}
+	lease, stop, done := lockState.lease, lockState.stop, lockState.done
+	lockState.lease = nil
+	lockState.Unlock()
+
+	// Wait for any renewal in flight so that the lease is deleted with its
+	// latest revision.
+	close(stop)
+	<-done
+
+	// The lease is released even if the operation was cancelled.
+	if err := deleteLease(context.Background(), lease, ahr); err != nil {
+		log.WithError(err).Error("Couldn't release the cluster lock!")
+	}
+}
+
+func takeLease(ctx context.Context, command string, ahr *httpUtils.AuthenticatedHttpRequester) (*Lease, error) {
+	if err := ensureDatabase(ctx, LocksDb, ahr); err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{Id: clusterLockId}
+	current, err := getLease(ctx, clusterLockId, ahr)
+	if err != nil && !httpUtils.IsStatus(err, http.StatusNotFound) {
+		return nil, err
+	}
+	if current != nil {
+		if !current.Expired() {
+			return nil, fmt.Errorf("Cluster is locked by %s running %s until %s", current.Holder, current.Command, current.ExpiresAt.Format(time.RFC3339))
+		}
+		log.WithFields(log.Fields{"holder": current.Holder, "command": current.Command}).Warn("Taking over expired cluster lock")
+		lease.Rev = current.Rev
+	}
+
+	now := time.Now().UTC()
+	lease.Holder = lockHolder
+	lease.Command = command
+	lease.AcquiredAt = now
+	lease.ExpiresAt = now.Add(lockTTL)
+
+	if err = putLease(ctx, lease, ahr); httpUtils.IsStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("Cluster lock was taken by someone else while acquiring it")
+	} else if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// renewLease extends the lease every third of its TTL until stop is closed.
+// The lease is only written by the renewer until it closes done. If renewing
+// fails it closes lost and gives up.
+func renewLease(ctx context.Context, lease *Lease, stop <-chan struct{}, done, lost chan<- struct{}, ahr *httpUtils.AuthenticatedHttpRequester) {
+	defer close(done)
+
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		renewed := *lease
+		renewed.ExpiresAt = time.Now().UTC().Add(lockTTL)
+		if err := putLease(ctx, &renewed, ahr); err != nil {
+			log.WithError(err).Error("Couldn't renew the cluster lock, aborting!")
+			close(lost)
+			return
+		}
+		*lease = renewed
+	}
+}
+
+func getLease(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) (*Lease, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/%s", ahr.Server(), LocksDb, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	if err = ahr.RunRequest(ctx, req, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func putLease(ctx context.Context, lease *Lease, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	b, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s/%s", ahr.Server(), LocksDb, lease.Id), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		Rev string `json:"rev"`
+	}
+	if err = ahr.RunRequest(ctx, req, &resp); err != nil {
+		return err
+	}
+	lease.Rev = resp.Rev
+	return nil
+}
+
+func deleteLease(ctx context.Context, lease *Lease, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/%s/%s?rev=%s", ahr.Server(), LocksDb, lease.Id, lease.Rev), nil)
+	if err != nil {
+		return err
+	}
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+func ListLocks(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]Lease, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_all_docs?include_docs=true", ahr.Server(), LocksDb), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Doc Lease `json:"doc"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); httpUtils.IsStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	leases := make([]Lease, 0, len(docs.Rows))
+	for _, row := range docs.Rows {
+		leases = append(leases, row.Doc)
+	}
+	return leases, nil
+}
+
+// ForceUnlock removes the cluster lease no matter who holds it. Meant to
+// recover from crashed runs that left a lease behind.
+func ForceUnlock(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	lease, err := getLease(ctx, clusterLockId, ahr)
+	if httpUtils.IsStatus(err, http.StatusNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = deleteLease(ctx, lease, ahr); err != nil {
+		return err
+	}
+	return record(ctx, "force_unlock", lease.Holder, lease, nil)
+}
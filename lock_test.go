@@ -0,0 +1,179 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func mockLocks() {
+	httpmock.RegisterResponder("HEAD", "http://127.0.0.1:5984/couchdb_admin_locks",
+		httpmock.NewStringResponder(200, ""))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "missing"}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(201, `{"ok": true, "id": "cluster", "rev": "1-967a00dff5e02add41819138abb3284d"}`))
+
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(200, `{"ok": true, "id": "cluster", "rev": "2-eec205a9d413992850a6e32678485900"}`))
+}
+
+func TestMutatingOperationsTakeAndReleaseTheLock(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var taken, released bool
+	httpmock.RegisterResponder("HEAD", "http://127.0.0.1:5984/couchdb_admin_locks",
+		httpmock.NewStringResponder(404, ""))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/couchdb_admin_locks",
+		httpmock.NewStringResponder(201, `{"ok": true}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "missing"}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		func(req *http.Request) (*http.Response, error) {
+			lease := Lease{}
+
+			if err := json.NewDecoder(req.Body).Decode(&lease); err != nil {
+				t.Error(err)
+			}
+
+			assert.Equal(t, lease.Holder, "tester@host")
+			assert.Equal(t, lease.Command, "set_config")
+			assert.True(t, lease.ExpiresAt.After(time.Now()))
+			taken = true
+
+			return httpmock.NewStringResponse(201, `{"ok": true, "id": "cluster", "rev": "1-967a00dff5e02add41819138abb3284d"}`), nil
+		})
+
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/couchdb_admin_locks/cluster?rev=1-967a00dff5e02add41819138abb3284d",
+		func(req *http.Request) (*http.Response, error) {
+			released = true
+			return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+		})
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/level",
+		httpmock.NewStringResponder(200, `"info"`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/level",
+		func(req *http.Request) (*http.Response, error) {
+			assert.True(t, taken, "Lock should be taken before mutating")
+			assert.False(t, released, "Lock should not be released before mutating")
+			return httpmock.NewStringResponse(200, `"info"`), nil
+		})
+
+	SetLockHolder("tester@host", time.Minute)
+	defer SetLockHolder(defaultLockHolder(), time.Minute)
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	node, err := NodeAt("127.0.0.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = node.SetConfig(context.Background(), "log", "level", "debug", ahr); err != nil {
+		t.Error(err)
+	}
+
+	assert.True(t, released, "Lock should be released after the operation")
+}
+
+func TestMutatingOperationsFailIfLockIsHeld(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("HEAD", "http://127.0.0.1:5984/couchdb_admin_locks",
+		httpmock.NewStringResponder(200, ""))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(200, `{
+			"_id": "cluster",
+			"_rev": "3-917fa2381192822767f010b95b45325b",
+			"holder": "someone@elsewhere:1234",
+			"command": "replicate",
+			"acquired_at": "`+time.Now().UTC().Format(time.RFC3339)+`",
+			"expires_at": "`+time.Now().Add(time.Minute).UTC().Format(time.RFC3339)+`"}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/log/level",
+		func(req *http.Request) (*http.Response, error) {
+			t.Error("Config should not be changed while the cluster is locked by someone else")
+			return httpmock.NewStringResponse(200, `"info"`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	node, err := NodeAt("127.0.0.1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = node.SetConfig(context.Background(), "log", "level", "debug", ahr)
+	assert.Error(t, err, "Operation should have been rejected as the cluster is locked by someone else")
+}
+
+func TestForceUnlockRemovesLease(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		httpmock.NewStringResponder(200, `{
+			"_id": "cluster",
+			"_rev": "3-917fa2381192822767f010b95b45325b",
+			"holder": "someone@elsewhere:1234",
+			"command": "replicate",
+			"acquired_at": "2017-07-03T10:21:16Z",
+			"expires_at": "2017-07-03T10:22:16Z"}`))
+
+	deleted := false
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/couchdb_admin_locks/cluster?rev=3-917fa2381192822767f010b95b45325b",
+		func(req *http.Request) (*http.Response, error) {
+			deleted = true
+			return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := ForceUnlock(context.Background(), ahr); err != nil {
+		t.Error(err)
+	}
+	assert.True(t, deleted)
+}
+
+func TestOperationIsCancelledWhenTheLeaseCantBeRenewed(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	puts := 0
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/couchdb_admin_locks/cluster",
+		func(req *http.Request) (*http.Response, error) {
+			puts++
+			if puts > 1 {
+				return httpmock.NewStringResponse(409, `{"error": "conflict", "reason": "Document update conflict."}`), nil
+			}
+			return httpmock.NewStringResponse(201, `{"ok": true, "id": "cluster", "rev": "1-967a00dff5e02add41819138abb3284d"}`), nil
+		})
+
+	SetLockHolder("tester@host", 30*time.Millisecond)
+	defer SetLockHolder(defaultLockHolder(), time.Minute)
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	ctx, release, err := acquireLock(context.Background(), "set_config", ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Operation should have been cancelled after losing the lease")
+	}
+}
@@ -1,8 +1,11 @@
 package couchdb_admin
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -13,35 +16,140 @@ type Node struct {
 	addr string
 }
 
+var (
+	defaultNodePrefix = "couchdb"
+	nodeNamePattern   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	hostLabelPattern  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+)
+
+// SetDefaultNodePrefix sets the name given to nodes identified only by their
+// host. It defaults to couchdb, as in couchdb@10.0.0.1.
+func SetDefaultNodePrefix(prefix string) {
+	defaultNodePrefix = prefix
+}
+
+// ParseNode accepts either a full node name (name@host) or a bare host, which
+// is then given the default prefix. Hosts can be IPv4 or IPv6 addresses or
+// DNS names. IPv6 addresses may be bracketed, as in couchdb@[::1], but are
+// kept unbracketed in the node's name as CouchDB does.
+func ParseNode(s string) (*Node, error) {
+	name, host := defaultNodePrefix, s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		name, host = s[:i], s[i+1:]
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		if ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"); net.ParseIP(ip) != nil {
+			host = ip
+		}
+	}
+
+	if !nodeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("Invalid node name %s in %s!", name, s)
+	}
+	if !isValidHost(host) {
+		return nil, fmt.Errorf("Invalid host %s in %s!", host, s)
+	}
+	return &Node{addr: name + "@" + host}, nil
+}
+
+// NodeAt is kept for compatibility, it behaves as ParseNode.
 func NodeAt(addr string) (*Node, error) {
-	n := &Node{
-		addr: fmt.Sprintf("couchdb@%s", addr),
+	return ParseNode(addr)
+}
+
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
 	}
-	return n, nil
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) > 63 || !hostLabelPattern.MatchString(label) {
+			return false
+		}
+	}
+	return true
 }
 
-func (n *Node) IntoMaintenance(ahr *httpUtils.AuthenticatedHttpRequester) error {
-	return n.setMaintenanceFlag(true, ahr)
+func (n *Node) IntoMaintenance(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	return n.setMaintenanceFlag(ctx, true, ahr)
 }
 
 func (n *Node) Addr() string {
 	return n.addr
 }
 
-func (n *Node) DisableMaintenance(ahr *httpUtils.AuthenticatedHttpRequester) error {
-	return n.setMaintenanceFlag(false, ahr)
+func (n *Node) DisableMaintenance(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	return n.setMaintenanceFlag(ctx, false, ahr)
+}
+
+func (n *Node) setMaintenanceFlag(ctx context.Context, value bool, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	return n.SetConfig(ctx, "couchdb", "maintenance_mode", strconv.FormatBool(value), ahr)
 }
 
-func (n *Node) setMaintenanceFlag(value bool, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	return n.SetConfig("couchdb", "maintenance_mode", strconv.FormatBool(value), ahr)
+type configValue struct {
+	Section string `json:"section"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	// Existed tells an unset key apart from one set to an empty value.
+	Existed bool `json:"existed"`
+}
+
+func (n *Node) GetConfig(ctx context.Context, section, key string, ahr *httpUtils.AuthenticatedHttpRequester) (string, error) {
+	req, err := httpUtils.NewNodeRequest("GET", fmt.Sprintf("http://%s:5984/_node/%s/_config/%s/%s", ahr.NodeHost(n.addr), n.addr, section, key), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var value string
+	if err = ahr.RunRequest(ctx, req, &value); err != nil {
+		return "", err
+	}
+	return value, nil
 }
 
-func (n *Node) SetConfig(section, key, value string, ahr *httpUtils.AuthenticatedHttpRequester) error {
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/_node/%s/_config/%s/%s", ahr.Server(), n.addr, section, key),
+func (n *Node) SetConfig(ctx context.Context, section, key, value string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "set_config", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = n.GetConfig(ctx, section, key, ahr)
+	if err != nil && !httpUtils.IsStatus(err, http.StatusNotFound) {
+		return err
+	}
+	existed := err == nil
+
+	req, err := httpUtils.NewNodeRequest("PUT", fmt.Sprintf("http://%s:5984/_node/%s/_config/%s/%s", ahr.NodeHost(n.addr), n.addr, section, key),
 		strings.NewReader(fmt.Sprintf("\"%s\"", value)))
 	if err != nil {
 		return err
 	}
 
-	return ahr.RunRequest(req, nil)
+	var oldValue string
+	if err = ahr.RunRequest(ctx, req, &oldValue); err != nil {
+		return err
+	}
+	return record(ctx, "set_config", n.addr, configValue{section, key, oldValue, existed}, configValue{section, key, value, true})
+}
+
+func (n *Node) DeleteConfig(ctx context.Context, section, key string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "delete_config", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	req, err := httpUtils.NewNodeRequest("DELETE", fmt.Sprintf("http://%s:5984/_node/%s/_config/%s/%s", ahr.NodeHost(n.addr), n.addr, section, key), nil)
+	if err != nil {
+		return err
+	}
+
+	var oldValue string
+	if err = ahr.RunRequest(ctx, req, &oldValue); err != nil {
+		return err
+	}
+	return record(ctx, "delete_config", n.addr, configValue{section, key, oldValue, true}, nil)
 }
@@ -0,0 +1,60 @@
+package couchdb_admin
+
+import (
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeAcceptsNamesAndHosts(t *testing.T) {
+	for input, expected := range map[string]string{
+		"127.0.0.1":                     "couchdb@127.0.0.1",
+		"couch-0.couchdb.svc.local":     "couchdb@couch-0.couchdb.svc.local",
+		"couch@10.0.0.1":                "couch@10.0.0.1",
+		"node_1@couch-1.example.com.":   "node_1@couch-1.example.com.",
+		"fd00::1":                       "couchdb@fd00::1",
+		"couch@2001:db8::8a2e:370:7334": "couch@2001:db8::8a2e:370:7334",
+	} {
+		node, err := ParseNode(input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		assert.Equal(t, expected, node.Addr())
+	}
+}
+
+func TestParseNodeStripsIPv6Brackets(t *testing.T) {
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	for input, expected := range map[string]string{
+		"couchdb@[::1]": "couchdb@::1",
+		"[fd00::1]":     "couchdb@fd00::1",
+	} {
+		node, err := ParseNode(input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		assert.Equal(t, expected, node.Addr())
+		assert.Equal(t, "["+expected[len("couchdb@"):]+"]", ahr.NodeHost(node.Addr()))
+	}
+}
+
+func TestParseNodeRejectsInvalidNames(t *testing.T) {
+	for _, input := range []string{"", "couchdb@", "@10.0.0.1", "couch db@10.0.0.1", "couchdb@-couch.example.com", "couchdb@couch_0.example.com", "couchdb@couch..example.com", "couchdb@[couch.example.com]"} {
+		_, err := ParseNode(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseNodeUsesDefaultPrefix(t *testing.T) {
+	SetDefaultNodePrefix("couch")
+	defer SetDefaultNodePrefix("couchdb")
+
+	node, err := ParseNode("10.0.0.1")
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, "couch@10.0.0.1", node.Addr())
+}
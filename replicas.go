@@ -0,0 +1,102 @@
+package couchdb_admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+type ReplicaPolicy struct {
+	// MinReplicas is the lowest number of copies any range may be left with.
+	// Zero derives it from the database's n, requiring a majority of them.
+	MinReplicas int
+	// Databases overrides MinReplicas for particular databases.
+	Databases map[string]int
+	// AllowUnderReplication lets operations go below the minimum, logging a
+	// warning instead of refusing. Ranges are never left without copies.
+	AllowUnderReplication bool
+	// RequireZoneSpread refuses, instead of just warning about, changes that
+	// leave every copy of a range in the same zone.
+	RequireZoneSpread bool
+}
+
+// DefaultReplicaPolicy requires a majority of each database's n, as the CLI
+// does unless told otherwise.
+var DefaultReplicaPolicy = ReplicaPolicy{}
+
+var replicaPolicy = DefaultReplicaPolicy
+
+// SetReplicaPolicy sets the minimum replica count enforced by every operation
+// removing replicas.
+func SetReplicaPolicy(policy ReplicaPolicy) {
+	replicaPolicy = policy
+}
+
+func (db *Database) minReplicas(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (int, error) {
+	if min, ok := replicaPolicy.Databases[db.name]; ok {
+		return min, nil
+	}
+	if replicaPolicy.MinReplicas > 0 {
+		return replicaPolicy.MinReplicas, nil
+	}
+
+	n, err := db.replicasN(ctx, ahr)
+	if err != nil {
+		return 0, err
+	}
+	return n/2 + 1, nil
+}
+
+func (db *Database) replicasN(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (int, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s", ahr.Server(), db.name), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var info struct {
+		Cluster struct {
+			N int `json:"n"`
+		} `json:"cluster"`
+	}
+	if err = ahr.RunRequest(ctx, req, &info); err != nil {
+		return 0, err
+	}
+	if info.Cluster.N == 0 {
+		return 0, fmt.Errorf("Could not retrieve the replicas number of %s", db.name)
+	}
+	return info.Cluster.N, nil
+}
+
+// checkReplicas enforces the minimum replica count on the number of copies
+// each range would be left with.
+func (db *Database) checkReplicas(ctx context.Context, remaining map[string]int, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	min, err := db.minReplicas(ctx, ahr)
+	if err != nil {
+		return err
+	}
+
+	shards := make([]string, 0, len(remaining))
+	for shard := range remaining {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	for _, shard := range shards {
+		if remaining[shard] >= min {
+			continue
+		}
+		if !replicaPolicy.AllowUnderReplication {
+			return fmt.Errorf("Shard %s of %s would be left with %d replicas, below the minimum of %d!", shard, db.name, remaining[shard], min)
+		}
+		log.WithFields(log.Fields{"db": db.name, "shard": shard, "replicas": remaining[shard], "min_replicas": min}).Warn("Allowing shard to be under-replicated!")
+	}
+	return nil
+}
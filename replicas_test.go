@@ -0,0 +1,83 @@
+package couchdb_admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+const replicasTestDbConfig = `{
+	"_id": "testdb",
+	"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+	"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+	"changelog": [],
+	"by_node": {
+		"couchdb@127.0.0.1": ["00000000-ffffffff"],
+		"couchdb@127.0.0.2": ["00000000-ffffffff"]
+	},
+	"by_range": {
+		"00000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]
+	}}`
+
+func TestRemoveReplicaEnforcesMinimumDerivedFromN(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	SetReplicaPolicy(DefaultReplicaPolicy)
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, replicasTestDbConfig))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/testdb",
+		httpmock.NewStringResponder(200, `{"db_name": "testdb", "cluster": {"q": 1, "n": 2, "w": 2, "r": 2}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr)
+	assert.Error(t, err, "Remove replica should have been rejected as a majority of n=2 is 2 replicas")
+	assert.Equal(t, db.config.ByRange, map[string][]string{
+		"00000000-ffffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+	})
+}
+
+func TestRemoveReplicaHonoursDatabaseOverrideAndAllowUnderReplication(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+	mockZones(nil)
+
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, replicasTestDbConfig))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, ""))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1, Databases: map[string]int{"testdb": 2}})
+	err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr)
+	assert.Error(t, err, "Remove replica should have been rejected by the database's minimum")
+
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1, Databases: map[string]int{"testdb": 2}, AllowUnderReplication: true})
+	if err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr); err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, db.config.ByRange, map[string][]string{
+		"00000000-ffffffff": []string{"couchdb@127.0.0.1"},
+	})
+}
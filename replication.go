@@ -0,0 +1,308 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// Replication is a replication job as stored in the _replicator database.
+type Replication struct {
+	Id           string              `json:"_id"`
+	Rev          string              `json:"_rev,omitempty"`
+	Source       ReplicationEndpoint `json:"source"`
+	Target       ReplicationEndpoint `json:"target"`
+	Continuous   bool                `json:"continuous,omitempty"`
+	CreateTarget bool                `json:"create_target,omitempty"`
+	Filter       string              `json:"filter,omitempty"`
+	QueryParams  map[string]string   `json:"query_params,omitempty"`
+	Selector     json.RawMessage     `json:"selector,omitempty"`
+	DocIds       []string            `json:"doc_ids,omitempty"`
+	State        string              `json:"_replication_state,omitempty"`
+	StateReason  string              `json:"_replication_state_reason,omitempty"`
+}
+
+// ReplicationEndpoint is the source or target of a replication. Credentials
+// are sent in its headers rather than in the url so that they are not shown
+// by the scheduler endpoints.
+type ReplicationEndpoint struct {
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NewReplicationEndpoint builds an endpoint authenticating with basic auth if
+// user is given.
+func NewReplicationEndpoint(rawurl, user, password string) ReplicationEndpoint {
+	endpoint := ReplicationEndpoint{Url: rawurl}
+	if user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		endpoint.Headers = map[string]string{"Authorization": "Basic " + credentials}
+	}
+	return endpoint
+}
+
+// UnmarshalJSON accepts endpoints given as a plain url too.
+func (e *ReplicationEndpoint) UnmarshalJSON(b []byte) error {
+	var rawurl string
+	if err := json.Unmarshal(b, &rawurl); err == nil {
+		*e = ReplicationEndpoint{Url: rawurl}
+		return nil
+	}
+
+	type endpoint ReplicationEndpoint
+	return json.Unmarshal(b, (*endpoint)(e))
+}
+
+// String returns the endpoint's url without any credentials on it.
+func (e ReplicationEndpoint) String() string {
+	u, err := url.Parse(e.Url)
+	if err != nil || u.User == nil {
+		return e.Url
+	}
+	u.User = nil
+	return u.String()
+}
+
+// redacted returns a copy of the replication without credentials, fit to be
+// journaled.
+func (r Replication) redacted() Replication {
+	r.Source = ReplicationEndpoint{Url: r.Source.String()}
+	r.Target = ReplicationEndpoint{Url: r.Target.String()}
+	return r
+}
+
+// ReplicationStatus merges what the scheduler knows about a replication
+// document and the job running it.
+type ReplicationStatus struct {
+	DocId       string `json:"doc_id"`
+	JobId       string `json:"job_id,omitempty"`
+	Node        string `json:"node,omitempty"`
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	State       string `json:"state"`
+	ErrorCount  int    `json:"error_count"`
+	LastError   string `json:"last_error,omitempty"`
+	LastUpdated string `json:"last_updated,omitempty"`
+	StartTime   string `json:"start_time,omitempty"`
+}
+
+// Failing tells whether the replication is crashing or has failed for good.
+func (s *ReplicationStatus) Failing() bool {
+	return s.State == "crashing" || s.State == "failed"
+}
+
+func CreateReplication(ctx context.Context, rep *Replication, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if rep.Id == "" {
+		return fmt.Errorf("Replication id is required!")
+	}
+	if rep.Source.Url == "" || rep.Target.Url == "" {
+		return fmt.Errorf("Replication source and target are required!")
+	}
+	if rep.Filter != "" && len(rep.Selector) > 0 {
+		return fmt.Errorf("A replication cannot have both a filter and a selector!")
+	}
+
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/_replicator/%s", ahr.Server(), url.PathEscape(rep.Id)), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		if httpUtils.IsStatus(err, http.StatusConflict) {
+			return fmt.Errorf("Replication %s already exists!", rep.Id)
+		}
+		return err
+	}
+	return record(ctx, "create_replication", rep.Id, nil, rep.redacted())
+}
+
+func LoadReplication(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) (*Replication, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_replicator/%s", ahr.Server(), url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var rep Replication
+	if err = ahr.RunRequest(ctx, req, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// ListReplications returns every replication document in _replicator.
+func ListReplications(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]Replication, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_replicator/_all_docs?include_docs=true", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Id  string      `json:"id"`
+			Doc Replication `json:"doc"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	var reps []Replication
+	for _, row := range docs.Rows {
+		if !strings.HasPrefix(row.Id, "_design/") {
+			reps = append(reps, row.Doc)
+		}
+	}
+	return reps, nil
+}
+
+func DeleteReplication(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	rep, err := LoadReplication(ctx, id, ahr)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/_replicator/%s?rev=%s", ahr.Server(), url.PathEscape(id), url.QueryEscape(rep.Rev)), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "delete_replication", id, rep.redacted(), nil)
+}
+
+// ReplicationStatuses reads the state of every _replicator document from
+// /_scheduler/docs and completes it with its running job from
+// /_scheduler/jobs.
+func ReplicationStatuses(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]ReplicationStatus, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_scheduler/docs/_replicator", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Docs []struct {
+			DocId       string          `json:"doc_id"`
+			Id          string          `json:"id"`
+			Node        string          `json:"node"`
+			Source      string          `json:"source"`
+			Target      string          `json:"target"`
+			State       string          `json:"state"`
+			ErrorCount  int             `json:"error_count"`
+			Info        json.RawMessage `json:"info"`
+			LastUpdated string          `json:"last_updated"`
+			StartTime   string          `json:"start_time"`
+		} `json:"docs"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	jobs, err := schedulerJobs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]ReplicationStatus, 0, len(docs.Docs))
+	for _, doc := range docs.Docs {
+		status := ReplicationStatus{
+			DocId:       doc.DocId,
+			JobId:       doc.Id,
+			Node:        doc.Node,
+			Source:      doc.Source,
+			Target:      doc.Target,
+			State:       doc.State,
+			ErrorCount:  doc.ErrorCount,
+			LastError:   schedulerInfoError(doc.Info),
+			LastUpdated: doc.LastUpdated,
+			StartTime:   doc.StartTime,
+		}
+		if job, exists := jobs[doc.DocId]; exists {
+			status.StartTime = job.StartTime
+			if status.LastError == "" {
+				status.LastError = job.lastCrash()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DocId < statuses[j].DocId })
+	return statuses, nil
+}
+
+type schedulerJob struct {
+	DocId     string `json:"doc_id"`
+	Database  string `json:"database"`
+	StartTime string `json:"start_time"`
+	History   []struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"history"`
+}
+
+// lastCrash returns the reason of the latest crash of the job. History is
+// sorted from the most recent event.
+func (j *schedulerJob) lastCrash() string {
+	for _, event := range j.History {
+		if event.Type == "crashed" {
+			return event.Reason
+		}
+	}
+	return ""
+}
+
+// schedulerJobs returns the running jobs of _replicator documents by doc id.
+func schedulerJobs(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (map[string]schedulerJob, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_scheduler/jobs", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Jobs []schedulerJob `json:"jobs"`
+	}
+	if err = ahr.RunRequest(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	jobs := make(map[string]schedulerJob, len(resp.Jobs))
+	for _, job := range resp.Jobs {
+		if job.Database == "_replicator" {
+			jobs[job.DocId] = job
+		}
+	}
+	return jobs, nil
+}
+
+// schedulerInfoError extracts the error from the info field of a scheduler
+// document, which is either an object with an error field or a bare string.
+func schedulerInfoError(info json.RawMessage) string {
+	if len(info) == 0 {
+		return ""
+	}
+
+	var obj struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(info, &obj); err == nil {
+		return obj.Error
+	}
+	var s string
+	if err := json.Unmarshal(info, &s); err == nil {
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,322 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// splitStates are the states a split job goes through, in order.
+var splitStates = []string{
+	"new", "initial_copy", "topoff1", "build_indices", "topoff2", "copy_local_docs",
+	"update_shardmap", "wait_source_close", "topoff3", "source_delete", "completed",
+}
+
+// ReshardJob is a shard splitting job as handled by CouchDB 3's /_reshard
+// API.
+type ReshardJob struct {
+	Id         string   `json:"id"`
+	Type       string   `json:"type"`
+	JobState   string   `json:"job_state"`
+	SplitState string   `json:"split_state"`
+	Node       string   `json:"node"`
+	Source     string   `json:"source"`
+	Targets    []string `json:"target"`
+	StartTime  string   `json:"start_time"`
+	UpdateTime string   `json:"update_time"`
+	StateInfo  struct {
+		Reason string `json:"reason"`
+	} `json:"state_info"`
+}
+
+type ReshardSummary struct {
+	State       string `json:"state"`
+	StateReason string `json:"state_reason"`
+	Completed   int    `json:"completed"`
+	Failed      int    `json:"failed"`
+	Running     int    `json:"running"`
+	Stopped     int    `json:"stopped"`
+	Total       int    `json:"total"`
+}
+
+// DbName returns the database the job works on, from its source shard.
+func (j *ReshardJob) DbName() string {
+	return shardDbName(j.Source)
+}
+
+// Progress returns how far the job is through its split states, in percent.
+func (j *ReshardJob) Progress() int {
+	for i, state := range splitStates {
+		if state == j.SplitState {
+			return i * 100 / (len(splitStates) - 1)
+		}
+	}
+	return 0
+}
+
+func (j *ReshardJob) Done() bool {
+	return j.JobState == "completed" || j.JobState == "failed"
+}
+
+// SplitRange returns the two ranges CouchDB splits range into.
+func SplitRange(shardRange string) ([2]string, error) {
+	var split [2]string
+	begin, end, err := parseRange(shardRange)
+	if err != nil || end == begin {
+		return split, fmt.Errorf("%s is not a shard range!", shardRange)
+	}
+
+	increment := (end - begin + 1) / 2
+	split[0] = fmt.Sprintf("%08x-%08x", begin, begin+increment-1)
+	split[1] = fmt.Sprintf("%08x-%08x", begin+increment, end)
+	return split, nil
+}
+
+func ReshardStatus(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (*ReshardSummary, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_reshard", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary ReshardSummary
+	if err = ahr.RunRequest(ctx, req, &summary); err != nil {
+		if httpUtils.IsStatus(err, http.StatusNotFound) {
+			return nil, fmt.Errorf("Resharding is not supported by this cluster, CouchDB 3 is required!")
+		}
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// CreateReshardJob creates the jobs splitting a database's range on every
+// node holding a copy of it, or only on node if given, and returns their ids.
+func CreateReshardJob(ctx context.Context, db, shardRange, node string, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	body := map[string]string{"type": "split", "db": db, "range": shardRange}
+	if node != "" {
+		body["node"] = node
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:5984/_reshard/jobs", ahr.Server()), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var results []struct {
+		Ok     bool   `json:"ok"`
+		Id     string `json:"id"`
+		Node   string `json:"node"`
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if err = ahr.RunRequest(ctx, req, &results); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, result := range results {
+		if !result.Ok {
+			return ids, fmt.Errorf("Could not create split job on %s: %s %s", result.Node, result.Error, result.Reason)
+		}
+		ids = append(ids, result.Id)
+	}
+	return ids, nil
+}
+
+func ListReshardJobs(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]ReshardJob, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_reshard/jobs", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Jobs []ReshardJob `json:"jobs"`
+	}
+	if err = ahr.RunRequest(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	sort.Slice(resp.Jobs, func(i, j int) bool { return resp.Jobs[i].Id < resp.Jobs[j].Id })
+	return resp.Jobs, nil
+}
+
+func LoadReshardJob(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) (*ReshardJob, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_reshard/jobs/%s", ahr.Server(), id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var job ReshardJob
+	if err = ahr.RunRequest(ctx, req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func StopReshardJob(ctx context.Context, id, reason string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	return setReshardJobState(ctx, "stop_reshard_job", id, "stopped", reason, ahr)
+}
+
+func ResumeReshardJob(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	return setReshardJobState(ctx, "resume_reshard_job", id, "running", "", ahr)
+}
+
+func setReshardJobState(ctx context.Context, command, id, state, reason string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, command, ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	job, err := LoadReshardJob(ctx, id, ahr)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{"state": state}
+	if reason != "" {
+		body["reason"] = reason
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/_reshard/jobs/%s/state", ahr.Server(), id), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, command, id, map[string]string{"state": job.JobState}, body)
+}
+
+// RemoveReshardJob removes a job, stopping it if it is running.
+func RemoveReshardJob(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "remove_reshard_job", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	job, err := LoadReshardJob(ctx, id, ahr)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:5984/_reshard/jobs/%s", ahr.Server(), id), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "remove_reshard_job", id, job, nil)
+}
+
+// WaitForReshardJobs blocks until every given job is done, checking every
+// interval. It fails if any job fails.
+func WaitForReshardJobs(ctx context.Context, ids []string, interval time.Duration, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		pending := 0
+		for _, id := range ids {
+			job, err := LoadReshardJob(ctx, id, ahr)
+			if err != nil {
+				return err
+			}
+			if job.JobState == "failed" {
+				return fmt.Errorf("Split job %s failed: %s", id, job.StateInfo.Reason)
+			}
+			if !job.Done() {
+				pending++
+				log.WithFields(log.Fields{"job": id, "node": job.Node, "state": job.JobState, "split_state": job.SplitState, "progress": job.Progress()}).Info("Waiting for split to finish...")
+			}
+		}
+		if pending == 0 {
+			return nil
+		}
+	}
+}
+
+// SplitShard splits a database's range in two on every node holding it, waits
+// for the jobs to finish and checks the new ranges are in the shard map.
+func (db *Database) SplitShard(ctx context.Context, shardRange string, interval time.Duration, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "split_shard", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err = db.refreshDbConfig(ctx, ahr); err != nil {
+		return err
+	}
+	nodes, exists := db.config.ByRange[shardRange]
+	if !exists {
+		return fmt.Errorf("%s is not a %s's shard!", shardRange, db.name)
+	}
+	if _, err = SplitRange(shardRange); err != nil {
+		return err
+	}
+
+	before, err := json.Marshal(db.config)
+	if err != nil {
+		return err
+	}
+
+	ids, err := CreateReshardJob(ctx, db.name, shardRange, "", ahr)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"db": db.name, "range": shardRange, "jobs": ids}).Info("Split jobs created")
+
+	if err = WaitForReshardJobs(ctx, ids, interval, ahr); err != nil {
+		return err
+	}
+	if err = db.checkSplit(ctx, shardRange, nodes, ahr); err != nil {
+		return err
+	}
+	return record(ctx, "split_shard", db.name, json.RawMessage(before), db.config)
+}
+
+// checkSplit verifies that shardRange has been replaced in the shard map by
+// its two halves, held by the same nodes.
+func (db *Database) checkSplit(ctx context.Context, shardRange string, nodes []string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if err := db.refreshDbConfig(ctx, ahr); err != nil {
+		return err
+	}
+	if _, exists := db.config.ByRange[shardRange]; exists {
+		return fmt.Errorf("%s is still in %s's shard map after splitting it!", shardRange, db.name)
+	}
+
+	split, err := SplitRange(shardRange)
+	if err != nil {
+		return err
+	}
+	expected := append([]string(nil), nodes...)
+	sort.Strings(expected)
+	for _, half := range split {
+		holders := append([]string(nil), db.config.ByRange[half]...)
+		sort.Strings(holders)
+		if strings.Join(holders, ",") != strings.Join(expected, ",") {
+			return fmt.Errorf("%s is held by %v instead of %v after splitting %s!", half, holders, expected, shardRange)
+		}
+	}
+	return nil
+}
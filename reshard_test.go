@@ -0,0 +1,127 @@
+package couchdb_admin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestSplitRange(t *testing.T) {
+	split, err := SplitRange("00000000-7fffffff")
+	assert.NoError(t, err)
+	assert.Equal(t, split, [2]string{"00000000-3fffffff", "40000000-7fffffff"})
+
+	split, err = SplitRange("80000000-ffffffff")
+	assert.NoError(t, err)
+	assert.Equal(t, split, [2]string{"80000000-bfffffff", "c0000000-ffffffff"})
+
+	_, err = SplitRange("00000000")
+	assert.Error(t, err)
+}
+
+func TestSplitShardWaitsForJobsAndChecksShardMap(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	configs := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			configs++
+			if configs == 1 {
+				return httpmock.NewStringResponse(200, `{
+	"_id": "testdb", "_rev": "1-abc",
+	"by_node": {"couchdb@127.0.0.1": ["00000000-7fffffff", "80000000-ffffffff"], "couchdb@127.0.0.2": ["00000000-7fffffff", "80000000-ffffffff"]},
+	"by_range": {"00000000-7fffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"], "80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{
+	"_id": "testdb", "_rev": "2-def",
+	"by_node": {"couchdb@127.0.0.1": ["00000000-3fffffff", "40000000-7fffffff", "80000000-ffffffff"], "couchdb@127.0.0.2": ["00000000-3fffffff", "40000000-7fffffff", "80000000-ffffffff"]},
+	"by_range": {"00000000-3fffffff": ["couchdb@127.0.0.2", "couchdb@127.0.0.1"], "40000000-7fffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"], "80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}}`), nil
+		})
+
+	httpmock.RegisterResponder("POST", "http://127.0.0.1:5984/_reshard/jobs",
+		httpmock.NewStringResponder(201, `[
+			{"ok": true, "id": "001-abc", "node": "couchdb@127.0.0.1", "shard": "shards/00000000-7fffffff/testdb.1496334581"},
+			{"ok": true, "id": "001-def", "node": "couchdb@127.0.0.2", "shard": "shards/00000000-7fffffff/testdb.1496334581"}]`))
+
+	polls := 0
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_reshard/jobs/001-abc",
+		func(req *http.Request) (*http.Response, error) {
+			polls++
+			if polls == 1 {
+				return httpmock.NewStringResponse(200, `{"id": "001-abc", "job_state": "running", "split_state": "build_indices"}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{"id": "001-abc", "job_state": "completed", "split_state": "completed"}`), nil
+		})
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_reshard/jobs/001-def",
+		httpmock.NewStringResponder(200, `{"id": "001-def", "job_state": "completed", "split_state": "completed"}`))
+
+	db := &Database{name: "testdb"}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := db.SplitShard(context.Background(), "00000000-7fffffff", time.Millisecond, ahr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, polls, 2)
+}
+
+func TestSplitShardFailsWhenAJobFails(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_reshard/jobs/001-abc",
+		httpmock.NewStringResponder(200, `{"id": "001-abc", "job_state": "failed", "split_state": "topoff1", "state_info": {"reason": "disk full"}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	err := WaitForReshardJobs(context.Background(), []string{"001-abc"}, time.Millisecond, ahr)
+	assert.EqualError(t, err, "Split job 001-abc failed: disk full")
+}
+
+func TestReshardJobProgress(t *testing.T) {
+	job := ReshardJob{SplitState: "new"}
+	assert.Equal(t, job.Progress(), 0)
+	job.SplitState = "update_shardmap"
+	assert.Equal(t, job.Progress(), 60)
+	job.SplitState = "completed"
+	assert.Equal(t, job.Progress(), 100)
+}
+
+func TestStopReshardJobIsLockedAndJournaled(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_reshard/jobs/001-abc",
+		httpmock.NewStringResponder(200, `{"id": "001-abc", "type": "split", "job_state": "running", "split_state": "initial_copy"}`))
+	var body string
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_reshard/jobs/001-abc/state",
+		func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = string(b)
+			return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := StopReshardJob(context.Background(), "001-abc", "maintenance", ahr); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, body, `{"state": "stopped", "reason": "maintenance"}`)
+
+	records, err := j.Records(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, records, 1)
+	assert.Equal(t, records[0].Command, "stop_reshard_job")
+	assert.Equal(t, records[0].Target, "001-abc")
+	assert.JSONEq(t, string(records[0].Before), `{"state": "running"}`)
+}
@@ -0,0 +1,164 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// Security is a database's _security object.
+type Security struct {
+	Admins  SecurityGroup `json:"admins"`
+	Members SecurityGroup `json:"members"`
+}
+
+type SecurityGroup struct {
+	Names []string `json:"names"`
+	Roles []string `json:"roles"`
+}
+
+func (g SecurityGroup) IsEmpty() bool {
+	return len(g.Names) == 0 && len(g.Roles) == 0
+}
+
+// IsPublic tells whether anybody can read the database, which is the case
+// when it has no members.
+func (s *Security) IsPublic() bool {
+	return s.Members.IsEmpty()
+}
+
+// normalize replaces missing names and roles with empty lists, as CouchDB
+// expects them to be arrays.
+func (s Security) normalize() Security {
+	for _, group := range []*SecurityGroup{&s.Admins, &s.Members} {
+		if group.Names == nil {
+			group.Names = []string{}
+		}
+		if group.Roles == nil {
+			group.Roles = []string{}
+		}
+	}
+	return s
+}
+
+func (db *Database) Security(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (*Security, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/%s/_security", ahr.Server(), db.name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var security Security
+	if err = ahr.RunRequest(ctx, req, &security); err != nil {
+		return nil, err
+	}
+	security = security.normalize()
+	return &security, nil
+}
+
+func (db *Database) SetSecurity(ctx context.Context, security *Security, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "set_security", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	before, err := db.Security(ctx, ahr)
+	if err != nil {
+		return err
+	}
+
+	after := security.normalize()
+	b, err := json.Marshal(after)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:5984/%s/_security", ahr.Server(), db.name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "set_security", db.name, before, after)
+}
+
+// SetSecurityMatching applies the same security object to every database
+// matching filter, returning the databases it was applied to. Protected
+// databases are only changed if filter's glob is their exact name.
+func SetSecurityMatching(ctx context.Context, filter DatabaseFilter, security *Security, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	ctx, release, err := acquireLock(ctx, "set_security", ahr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	dbs, err := securityTargets(ctx, filter, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []string
+	for _, name := range dbs {
+		log.WithField("db", name).Debug("Setting security...")
+		db := &Database{name: name}
+		if err = db.SetSecurity(ctx, security, ahr); err != nil {
+			return updated, fmt.Errorf("Could not set security of %s: %s", name, err)
+		}
+		updated = append(updated, name)
+	}
+	return updated, nil
+}
+
+// securityTargets returns the databases SetSecurityMatching applies to.
+// Protected databases are skipped unless filter names them exactly.
+func securityTargets(ctx context.Context, filter DatabaseFilter, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range dbs {
+		if !filter.Match(name) {
+			continue
+		}
+		if IsProtectedDatabase(name) && filter.Glob != name {
+			log.WithField("db", name).Debug("Skipping protected database...")
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// PublicDatabases returns the databases matching filter that anybody can
+// read.
+func PublicDatabases(ctx context.Context, filter DatabaseFilter, ahr *httpUtils.AuthenticatedHttpRequester) ([]string, error) {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	var public []string
+	for _, name := range dbs {
+		if !filter.Match(name) {
+			continue
+		}
+		db := &Database{name: name}
+		security, err := db.Security(ctx, ahr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get security of %s: %s", name, err)
+		}
+		if security.IsPublic() {
+			public = append(public, name)
+		}
+	}
+	return public, nil
+}
@@ -0,0 +1,104 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestSetSecurityMatchingOnlyTouchesMatchingDatabases(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["_users", "tenant_a", "tenant_b", "other"]`))
+
+	written := make(map[string]Security)
+	for _, name := range []string{"tenant_a", "tenant_b"} {
+		name := name
+		httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/"+name+"/_security",
+			httpmock.NewStringResponder(200, `{}`))
+		httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/"+name+"/_security",
+			func(req *http.Request) (*http.Response, error) {
+				var security Security
+				b, _ := ioutil.ReadAll(req.Body)
+				if err := json.Unmarshal(b, &security); err != nil {
+					return nil, err
+				}
+				written[name] = security
+				return httpmock.NewStringResponse(200, `{"ok": true}`), nil
+			})
+	}
+
+	security := &Security{Members: SecurityGroup{Roles: []string{"tenant"}}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	updated, err := SetSecurityMatching(context.Background(), DatabaseFilter{Glob: "tenant_*"}, security, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, updated, []string{"tenant_a", "tenant_b"})
+	expected := Security{
+		Admins:  SecurityGroup{Names: []string{}, Roles: []string{}},
+		Members: SecurityGroup{Names: []string{}, Roles: []string{"tenant"}},
+	}
+	assert.Equal(t, written["tenant_a"], expected)
+	assert.Equal(t, written["tenant_b"], expected)
+}
+
+func TestSetSecurityMatchingSkipsProtectedDatabasesUnlessNamed(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["_replicator", "_users", "tenant_a"]`))
+	for _, name := range []string{"_users", "tenant_a"} {
+		httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/"+name+"/_security",
+			httpmock.NewStringResponder(200, `{}`))
+		httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/"+name+"/_security",
+			httpmock.NewStringResponder(200, `{"ok": true}`))
+	}
+
+	security := &Security{Members: SecurityGroup{Roles: []string{"tenant"}}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	updated, err := SetSecurityMatching(context.Background(), DatabaseFilter{Glob: "*"}, security, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"tenant_a"}, updated)
+
+	updated, err = SetSecurityMatching(context.Background(), DatabaseFilter{Glob: "_users"}, security, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"_users"}, updated)
+}
+
+func TestPublicDatabasesListsDatabasesWithoutMembers(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["_users", "private", "public", "admins_only"]`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/private/_security",
+		httpmock.NewStringResponder(200, `{"members": {"names": ["alice"]}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/public/_security",
+		httpmock.NewStringResponder(200, `{}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/admins_only/_security",
+		httpmock.NewStringResponder(200, `{"admins": {"roles": ["ops"]}, "members": {"names": [], "roles": []}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	public, err := PublicDatabases(context.Background(), DatabaseFilter{SkipSystem: true}, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, public, []string{"public", "admins_only"})
+}
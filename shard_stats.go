@@ -0,0 +1,93 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// ShardCopyStats describes the copy of a database's range held by a node, as
+// read from the node-local shard database.
+type ShardCopyStats struct {
+	Range       string `json:"range"`
+	Node        string `json:"node"`
+	DocCount    int64  `json:"doc_count"`
+	DocDelCount int64  `json:"doc_del_count"`
+	FileSize    int64  `json:"file_size"`
+	ActiveSize  int64  `json:"active_size"`
+	UpdateSeq   string `json:"update_seq"`
+	// Diverges is set when the copy's documents count differs from the
+	// biggest copy of the same range by more than the allowed tolerance.
+	Diverges bool   `json:"diverges"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ShardStats reads the stats of every copy of every range of the database.
+// Copies whose documents count is more than tolerance (a fraction, e.g. 0.05)
+// away from their range's biggest copy are flagged as diverging. Copies that
+// cannot be read are reported with their error rather than failing.
+func (db *Database) ShardStats(ctx context.Context, tolerance float64, ahr *httpUtils.AuthenticatedHttpRequester) ([]ShardCopyStats, error) {
+	if err := db.refreshDbConfig(ctx, ahr); err != nil {
+		return nil, err
+	}
+
+	shards := make([]string, 0, len(db.config.ByRange))
+	for shard := range db.config.ByRange {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	var stats []ShardCopyStats
+	for _, shard := range shards {
+		nodes := append([]string(nil), db.config.ByRange[shard]...)
+		sort.Strings(nodes)
+
+		first := len(stats)
+		var biggest int64
+		for _, node := range nodes {
+			copyStats, err := db.shardCopyStats(ctx, shard, node, ahr)
+			if err != nil {
+				copyStats = ShardCopyStats{Range: shard, Node: node, Error: err.Error()}
+			} else if copyStats.DocCount > biggest {
+				biggest = copyStats.DocCount
+			}
+			stats = append(stats, copyStats)
+		}
+
+		for i := first; i < len(stats); i++ {
+			if stats[i].Error == "" && float64(biggest-stats[i].DocCount) > tolerance*float64(biggest) {
+				stats[i].Diverges = true
+			}
+		}
+	}
+	return stats, nil
+}
+
+func (db *Database) shardCopyStats(ctx context.Context, shard, node string, ahr *httpUtils.AuthenticatedHttpRequester) (ShardCopyStats, error) {
+	req, err := httpUtils.NewNodeRequest("GET", fmt.Sprintf("http://%s:5986/%s", ahr.NodeHost(node), url.PathEscape(db.config.ShardDbName(shard))), nil)
+	if err != nil {
+		return ShardCopyStats{}, err
+	}
+
+	var info struct {
+		DatabaseInfo
+		UpdateSeq json.RawMessage `json:"update_seq"`
+	}
+	if err = ahr.RunRequest(ctx, req, &info); err != nil {
+		return ShardCopyStats{}, err
+	}
+	return ShardCopyStats{
+		Range:       shard,
+		Node:        node,
+		DocCount:    info.DocCount,
+		DocDelCount: info.DocDelCount,
+		FileSize:    info.Sizes.File,
+		ActiveSize:  info.Sizes.Active,
+		UpdateSeq:   strings.Trim(string(info.UpdateSeq), `"`),
+	}, nil
+}
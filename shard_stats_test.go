@@ -0,0 +1,74 @@
+package couchdb_admin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestShardStatsFlagsDivergingCopies(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+	"_id": "testdb", "_rev": "1-abc",
+	"shard_suffix": [46, 49, 52, 57, 54],
+	"by_node": {"couchdb@127.0.0.1": ["00000000-7fffffff", "80000000-ffffffff"], "couchdb@127.0.0.2": ["00000000-7fffffff", "80000000-ffffffff"]},
+	"by_range": {"00000000-7fffffff": ["couchdb@127.0.0.2", "couchdb@127.0.0.1"], "80000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/shards%2F00000000-7fffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(200, `{"doc_count": 1000, "doc_del_count": 10, "update_seq": 1200, "sizes": {"file": 4096, "active": 2048}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5986/shards%2F00000000-7fffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(200, `{"doc_count": 800, "doc_del_count": 8, "update_seq": 950, "sizes": {"file": 3072, "active": 1536}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/shards%2F80000000-ffffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(200, `{"doc_count": 1000, "doc_del_count": 0, "update_seq": "1000-g1AAAA", "sizes": {"file": 4096, "active": 2048}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5986/shards%2F80000000-ffffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(200, `{"doc_count": 990, "doc_del_count": 0, "update_seq": "990-g1AAAA", "sizes": {"file": 4096, "active": 2040}}`))
+
+	db := &Database{name: "testdb"}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	stats, err := db.ShardStats(context.Background(), 0.05, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, stats, 4)
+	assert.Equal(t, stats[0], ShardCopyStats{Range: "00000000-7fffffff", Node: "couchdb@127.0.0.1", DocCount: 1000, DocDelCount: 10, FileSize: 4096, ActiveSize: 2048, UpdateSeq: "1200"})
+	assert.Equal(t, stats[1].Node, "couchdb@127.0.0.2")
+	assert.True(t, stats[1].Diverges)
+	assert.False(t, stats[2].Diverges)
+	assert.Equal(t, stats[3].UpdateSeq, "990-g1AAAA")
+	assert.False(t, stats[3].Diverges)
+}
+
+func TestShardStatsReportsUnreachableCopies(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+	"_id": "testdb", "_rev": "1-abc",
+	"shard_suffix": [46, 49, 52, 57, 54],
+	"by_node": {"couchdb@127.0.0.1": ["00000000-ffffffff"], "couchdb@127.0.0.2": ["00000000-ffffffff"]},
+	"by_range": {"00000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2"]}}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/shards%2F00000000-ffffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(200, `{"doc_count": 10, "update_seq": 10}`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5986/shards%2F00000000-ffffffff%2Ftestdb.1496",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "no_db_file"}`))
+
+	db := &Database{name: "testdb"}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	stats, err := db.ShardStats(context.Background(), 0.05, ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, stats, 2)
+	assert.Empty(t, stats[0].Error)
+	assert.NotEmpty(t, stats[1].Error)
+	assert.False(t, stats[1].Diverges)
+}
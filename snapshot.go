@@ -0,0 +1,217 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/cabify/couchdb-admin/sliceUtils"
+)
+
+type ShardMapSnapshot struct {
+	TakenAt   time.Time         `json:"taken_at"`
+	Databases map[string]Config `json:"databases"`
+}
+
+func SnapshotShardMaps(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (*ShardMapSnapshot, error) {
+	dbs, err := AllDbs(ctx, ahr)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &ShardMapSnapshot{
+		TakenAt:   time.Now().UTC(),
+		Databases: make(map[string]Config, len(dbs)),
+	}
+
+	for _, db_name := range dbs {
+		log.WithField("db", db_name).Debug("Taking database's shard map...")
+		db, err := LoadDB(ctx, db_name, ahr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not access the %s database", db_name)
+		}
+		config := db.config
+		config.Rev = ""
+		snapshot.Databases[db_name] = config
+	}
+
+	return snapshot, nil
+}
+
+func LoadShardMapSnapshot(r io.Reader) (*ShardMapSnapshot, error) {
+	var snapshot ShardMapSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if len(snapshot.Databases) == 0 {
+		return nil, fmt.Errorf("Snapshot does not contain any database!")
+	}
+	return &snapshot, nil
+}
+
+func (s *ShardMapSnapshot) Save(w io.Writer) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Restore reapplies the placement recorded in the snapshot. If dbName is empty
+// every database in the snapshot is restored: those no longer in the cluster
+// are skipped with a warning and the others are restored even if some fail,
+// returning their errors at the end.
+func (s *ShardMapSnapshot) Restore(ctx context.Context, dbName string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "restore_shard_maps", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return err
+	}
+
+	if dbName != "" {
+		if _, exists := s.Databases[dbName]; !exists {
+			return fmt.Errorf("Database %s is not part of the snapshot!", dbName)
+		}
+		db, err := LoadDB(ctx, dbName, ahr)
+		if err != nil {
+			return fmt.Errorf("Could not access the %s database", dbName)
+		}
+		return db.restoreShardMap(ctx, s.Databases[dbName], cluster, ahr)
+	}
+
+	names := make([]string, 0, len(s.Databases))
+	for name := range s.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []string
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		db, err := LoadDB(ctx, name, ahr)
+		if httpUtils.IsStatus(err, http.StatusNotFound) {
+			log.WithField("db", name).Warn("Database no longer exists, skipping it")
+			continue
+		} else if err != nil {
+			err = fmt.Errorf("Could not access the %s database", name)
+		} else {
+			err = db.restoreShardMap(ctx, s.Databases[name], cluster, ahr)
+		}
+		if err != nil {
+			log.WithField("db", name).WithError(err).Error("Couldn't restore shard map!")
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Could not restore %d of %d databases: %s", len(failures), len(names), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (db *Database) restoreShardMap(ctx context.Context, snapshot Config, cluster *Cluster, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if len(snapshot.ByRange) != len(db.config.ByRange) {
+		return fmt.Errorf("Shards of %s changed since the snapshot was taken!", db.name)
+	}
+
+	shards := make([]string, 0, len(snapshot.ByRange))
+	for shard, nodes := range snapshot.ByRange {
+		if _, exists := db.config.ByRange[shard]; !exists {
+			return fmt.Errorf("%s is no longer a %s's shard!", shard, db.name)
+		}
+		for _, node := range nodes {
+			if !cluster.IsNodeUpAndJoined(node) {
+				return fmt.Errorf("Refusing to restore %s: %s is no longer part of the cluster!", db.name, node)
+			}
+		}
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	additions, removals := shardMapChanges(db.config, snapshot)
+	var newReplicas []string
+	for _, shard := range shards {
+		for _, node := range additions[shard] {
+			if !sliceUtils.Contains(newReplicas, node) {
+				newReplicas = append(newReplicas, node)
+			}
+		}
+	}
+
+	if len(additions) == 0 && len(removals) == 0 {
+		log.WithField("db", db.name).Info("Shard map already matches the snapshot")
+		return nil
+	}
+
+	remaining := make(map[string]int, len(removals))
+	for shard := range removals {
+		remaining[shard] = len(snapshot.ByRange[shard])
+	}
+	if err := db.checkReplicas(ctx, remaining, ahr); err != nil {
+		return err
+	}
+
+	before, err := json.Marshal(db.config)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range newReplicas {
+		node := &Node{addr: addr}
+		if err := node.IntoMaintenance(ctx, ahr); err != nil {
+			return err
+		}
+		log.WithField("node", addr).Warn("Node was sent into maintenance!. Remember to reenable it once it catches up with changes")
+	}
+
+	for _, shard := range shards {
+		for _, node := range additions[shard] {
+			log.WithFields(log.Fields{"db": db.name, "shard": shard, "replica": node}).Info("Restoring replica...")
+			db.addReplica(shard, node)
+		}
+		for _, node := range removals[shard] {
+			log.WithFields(log.Fields{"db": db.name, "shard": shard, "replica": node}).Info("Removing replica...")
+			if err := db.removeReplica(shard, node); err != nil {
+				return err
+			}
+		}
+	}
+	return db.saveConfig(ctx, "restore_shard_map", before, ahr)
+}
+
+// shardMapChanges returns the replicas to add to and remove from each range of
+// current so that it matches target.
+func shardMapChanges(current, target Config) (additions, removals map[string][]string) {
+	additions = make(map[string][]string)
+	removals = make(map[string][]string)
+	for shard, nodes := range target.ByRange {
+		for _, node := range nodes {
+			if !sliceUtils.Contains(current.ByRange[shard], node) {
+				additions[shard] = append(additions[shard], node)
+			}
+		}
+	}
+	for shard, nodes := range current.ByRange {
+		for _, node := range nodes {
+			if !sliceUtils.Contains(target.ByRange[shard], node) {
+				removals[shard] = append(removals[shard], node)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestSnapshotShardMapsSavesAllDbs(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_all_dbs",
+		httpmock.NewStringResponder(200, `["testdb"]`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [
+				[
+					"add",
+					"00000000-ffffffff",
+					"couchdb@127.0.0.1"
+				]
+			],
+			"by_node": {
+				"couchdb@127.0.0.1": [ "00000000-ffffffff" ]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1"]
+			}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	snapshot, err := SnapshotShardMaps(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, snapshot.Databases["testdb"].Id, "testdb")
+	assert.Equal(t, snapshot.Databases["testdb"].Rev, "")
+	assert.Equal(t, snapshot.Databases["testdb"].ByRange, map[string][]string{"00000000-ffffffff": []string{"couchdb@127.0.0.1"}})
+
+	var buf bytes.Buffer
+	if err = snapshot.Save(&buf); err != nil {
+		t.Error(err)
+	}
+	assert.NotContains(t, buf.String(), "_rev")
+
+	loaded, err := LoadShardMapSnapshot(&buf)
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, loaded.Databases, snapshot.Databases)
+}
+
+func TestRestoreShardMapsReappliesPlacement(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"],
+	"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"]}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "2-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": [ "00000000-7fffffff", "80000000-ffffffff" ],
+				"couchdb@127.0.0.3": [ "00000000-7fffffff" ]
+			},
+			"by_range": {
+				"00000000-7fffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.3"],
+				"80000000-ffffffff": ["couchdb@127.0.0.1"]
+			}}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
+		httpmock.NewStringResponder(200, `"false"`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/couchdb/maintenance_mode",
+		httpmock.NewStringResponder(200, `"false"`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_dbs/testdb",
+		func(req *http.Request) (*http.Response, error) {
+			body := Config{}
+
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+
+			assert.Equal(t, body.Rev, "2-5e2d10c29c70d3869fb7a1fd3a827a64")
+			assert.Equal(t, body.ByNode, map[string][]string{
+				"couchdb@127.0.0.1": []string{"00000000-7fffffff", "80000000-ffffffff"},
+				"couchdb@127.0.0.2": []string{"00000000-7fffffff"},
+			})
+			assert.Equal(t, body.ByRange, map[string][]string{
+				"00000000-7fffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+				"80000000-ffffffff": []string{"couchdb@127.0.0.1"},
+			})
+
+			return httpmock.NewStringResponse(200, ""), nil
+		})
+
+	snapshot := &ShardMapSnapshot{
+		Databases: map[string]Config{
+			"testdb": Config{
+				Id: "testdb",
+				ByNode: map[string][]string{
+					"couchdb@127.0.0.1": []string{"00000000-7fffffff", "80000000-ffffffff"},
+					"couchdb@127.0.0.2": []string{"00000000-7fffffff"},
+				},
+				ByRange: map[string][]string{
+					"00000000-7fffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+					"80000000-ffffffff": []string{"couchdb@127.0.0.1"},
+				},
+			},
+		},
+	}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := snapshot.Restore(context.Background(), "testdb", ahr); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreShardMapsRefusesNodesNotInCluster(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "2-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": [ "00000000-ffffffff" ]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1"]
+			}}`))
+
+	snapshot := &ShardMapSnapshot{
+		Databases: map[string]Config{
+			"testdb": Config{
+				Id: "testdb",
+				ByNode: map[string][]string{
+					"couchdb@127.0.0.1": []string{"00000000-ffffffff"},
+					"couchdb@127.0.0.9": []string{"00000000-ffffffff"},
+				},
+				ByRange: map[string][]string{
+					"00000000-ffffffff": []string{"couchdb@127.0.0.1", "couchdb@127.0.0.9"},
+				},
+			},
+		},
+	}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	err := snapshot.Restore(context.Background(), "", ahr)
+	assert.Error(t, err, "Restore should have been rejected as 127.0.0.9 is not part of the cluster")
+}
+
+func TestRestoreShardMapsSkipsMissingDatabases(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/gonedb",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "missing"}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "2-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": [ "00000000-ffffffff" ]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1"]
+			}}`))
+
+	layout := Config{
+		ByNode:  map[string][]string{"couchdb@127.0.0.1": []string{"00000000-ffffffff"}},
+		ByRange: map[string][]string{"00000000-ffffffff": []string{"couchdb@127.0.0.1"}},
+	}
+	snapshot := &ShardMapSnapshot{
+		Databases: map[string]Config{"gonedb": layout, "testdb": layout},
+	}
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	assert.NoError(t, snapshot.Restore(context.Background(), "", ahr))
+}
@@ -0,0 +1,106 @@
+package couchdb_admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+type ActiveTask struct {
+	Node           string `json:"node"`
+	Pid            string `json:"pid"`
+	Type           string `json:"type"`
+	Database       string `json:"database,omitempty"`
+	DesignDocument string `json:"design_document,omitempty"`
+	Phase          string `json:"phase,omitempty"`
+	Source         string `json:"source,omitempty"`
+	Target         string `json:"target,omitempty"`
+	DocId          string `json:"doc_id,omitempty"`
+	Progress       int    `json:"progress"`
+	ChangesDone    int64  `json:"changes_done"`
+	TotalChanges   int64  `json:"total_changes"`
+	StartedOn      int64  `json:"started_on"`
+	UpdatedOn      int64  `json:"updated_on"`
+}
+
+// DbName returns the name of the database the task works on, stripping the
+// shard path from node-local database names such as
+// shards/00000000-7fffffff/mydb.1496334581.
+func (t *ActiveTask) DbName() string {
+	return shardDbName(t.Database)
+}
+
+// Shard returns the range the task works on, if it runs on a shard.
+func (t *ActiveTask) Shard() string {
+	parts := strings.SplitN(t.Database, "/", 3)
+	if len(parts) != 3 || parts[0] != "shards" {
+		return ""
+	}
+	return parts[1]
+}
+
+func shardDbName(name string) string {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[0] != "shards" {
+		return name
+	}
+	name = parts[2]
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// ActiveTasks reads the tasks running on every node from the clustered
+// interface, which tags each of them with its node.
+func ActiveTasks(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]ActiveTask, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_active_tasks", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []ActiveTask
+	if err = ahr.RunRequest(ctx, req, &tasks); err != nil {
+		return nil, fmt.Errorf("Could not read active tasks: %s", err)
+	}
+	return tasks, nil
+}
+
+// ActiveTasks reads the tasks running on every node of the cluster.
+func (cluster *Cluster) ActiveTasks(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]ActiveTask, error) {
+	return ActiveTasks(ctx, ahr)
+}
+
+type TaskGroup struct {
+	Type     string       `json:"type"`
+	Database string       `json:"database"`
+	Tasks    []ActiveTask `json:"tasks"`
+}
+
+// GroupTasks groups tasks by type and database, sorted by both.
+func GroupTasks(tasks []ActiveTask) []TaskGroup {
+	index := make(map[[2]string]int)
+	var groups []TaskGroup
+	for _, task := range tasks {
+		key := [2]string{task.Type, task.DbName()}
+		i, exists := index[key]
+		if !exists {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, TaskGroup{Type: key[0], Database: key[1]})
+		}
+		groups[i].Tasks = append(groups[i].Tasks, task)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Type != groups[j].Type {
+			return groups[i].Type < groups[j].Type
+		}
+		return groups[i].Database < groups[j].Database
+	})
+	return groups
+}
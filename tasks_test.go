@@ -0,0 +1,25 @@
+package couchdb_admin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupTasksByTypeAndDatabase(t *testing.T) {
+	tasks := []ActiveTask{
+		{Node: "couchdb@127.0.0.1", Type: "indexer", Database: "shards/00000000-7fffffff/testdb.1496334581"},
+		{Node: "couchdb@127.0.0.1", Type: "database_compaction", Database: "shards/00000000-7fffffff/otherdb.1496334590"},
+		{Node: "couchdb@127.0.0.2", Type: "indexer", Database: "shards/80000000-ffffffff/testdb.1496334581"},
+		{Node: "couchdb@127.0.0.2", Type: "indexer", Database: "shards/80000000-ffffffff/otherdb.1496334590"},
+	}
+
+	groups := GroupTasks(tasks)
+
+	assert.Len(t, groups, 3)
+	assert.Equal(t, groups[0].Type, "database_compaction")
+	assert.Equal(t, groups[1].Type, "indexer")
+	assert.Equal(t, groups[1].Database, "otherdb")
+	assert.Equal(t, groups[2].Database, "testdb")
+	assert.Equal(t, groups[2].Tasks, []ActiveTask{tasks[0], tasks[2]})
+}
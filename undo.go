@@ -0,0 +1,164 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// Undo applies the inverse of the journaled operation with the given id after
+// checking that the affected resource has not changed since.
+func Undo(ctx context.Context, id string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "undo", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rec, err := FindJournalRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"id": rec.Id, "command": rec.Command, "target": rec.Target}).Debug("Found journaled operation")
+
+	switch rec.Command {
+	case "replicate", "remove_replica", "restore_shard_map", "set_layout":
+		return undoShardMapChange(ctx, rec, ahr)
+	case "add_node":
+		return undoAddNode(ctx, rec, ahr)
+	case "remove_node":
+		return undoRemoveNode(ctx, rec, ahr)
+	case "set_config", "delete_config":
+		return undoConfigChange(ctx, rec, ahr)
+	case "set_node_zone":
+		return undoSetNodeZone(ctx, rec, ahr)
+	case "set_security":
+		return undoSetSecurity(ctx, rec, ahr)
+	default:
+		return fmt.Errorf("Operation %s cannot be undone", rec.Command)
+	}
+}
+
+func undoShardMapChange(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	var before, after Config
+	if err := json.Unmarshal(rec.Before, &before); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rec.After, &after); err != nil {
+		return err
+	}
+
+	db, err := LoadDB(ctx, rec.Target, ahr)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(db.config.ByRange, after.ByRange) {
+		return fmt.Errorf("Shard map of %s changed since operation %s, refusing to undo it", db.name, rec.Id)
+	}
+
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	return db.restoreShardMap(ctx, before, cluster, ahr)
+}
+
+func undoAddNode(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if rec.Before != nil {
+		return fmt.Errorf("%s was already known by the cluster before operation %s, refusing to remove it", rec.Target, rec.Id)
+	}
+
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	if !cluster.knowsNode(rec.Target) {
+		return fmt.Errorf("%s is not part of the cluster anymore", rec.Target)
+	}
+	return cluster.RemoveNode(ctx, &Node{addr: rec.Target}, ahr)
+}
+
+func undoRemoveNode(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	return cluster.AddNode(ctx, rec.Target, ahr)
+}
+
+func undoConfigChange(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	var before configValue
+	if err := json.Unmarshal(rec.Before, &before); err != nil {
+		return err
+	}
+	after := configValue{Section: before.Section, Key: before.Key}
+	if rec.After != nil {
+		if err := json.Unmarshal(rec.After, &after); err != nil {
+			return err
+		}
+	}
+
+	node := &Node{addr: rec.Target}
+	current, err := node.GetConfig(ctx, before.Section, before.Key, ahr)
+	if err != nil && rec.After != nil {
+		return err
+	}
+	if current != after.Value {
+		return fmt.Errorf("[%s] %s on %s changed since operation %s, refusing to undo it", before.Section, before.Key, rec.Target, rec.Id)
+	}
+
+	if !before.Existed {
+		return node.DeleteConfig(ctx, before.Section, before.Key, ahr)
+	}
+	return node.SetConfig(ctx, before.Section, before.Key, before.Value, ahr)
+}
+
+func undoSetNodeZone(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	var before, after map[string]string
+	if err := json.Unmarshal(rec.Before, &before); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rec.After, &after); err != nil {
+		return err
+	}
+
+	zones, err := NodeZones(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	if zones[rec.Target] != after["zone"] {
+		return fmt.Errorf("Zone of %s changed since operation %s, refusing to undo it", rec.Target, rec.Id)
+	}
+
+	cluster, err := LoadCluster(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	return cluster.SetNodeZone(ctx, &Node{addr: rec.Target}, before["zone"], ahr)
+}
+
+func undoSetSecurity(ctx context.Context, rec *JournalRecord, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	var before, after Security
+	if err := json.Unmarshal(rec.Before, &before); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rec.After, &after); err != nil {
+		return err
+	}
+
+	db := &Database{name: rec.Target}
+	current, err := db.Security(ctx, ahr)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(*current, after.normalize()) {
+		return fmt.Errorf("Security of %s changed since operation %s, refusing to undo it", rec.Target, rec.Id)
+	}
+	return db.SetSecurity(ctx, &before, ahr)
+}
@@ -0,0 +1,411 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+const userPrefix = "org.couchdb.user:"
+
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+func userDocUrl(name string, ahr *httpUtils.AuthenticatedHttpRequester) string {
+	return fmt.Sprintf("http://%s:5984/_users/%s", ahr.Server(), url.PathEscape(userPrefix+name))
+}
+
+// AddUser creates a user in _users. CouchDB hashes the password when saving
+// the document.
+func AddUser(ctx context.Context, name, password string, roles []string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if name == "" || password == "" {
+		return fmt.Errorf("User name and password are required!")
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+
+	ctx, release, err := acquireLock(ctx, "add_user", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	doc := map[string]interface{}{
+		"_id":      userPrefix + name,
+		"name":     name,
+		"type":     "user",
+		"roles":    roles,
+		"password": password,
+	}
+	if err = putUserDoc(ctx, name, doc, ahr); err != nil {
+		if httpUtils.IsStatus(err, http.StatusConflict) {
+			return fmt.Errorf("User %s already exists!", name)
+		}
+		return err
+	}
+	return record(ctx, "add_user", name, nil, User{Name: name, Roles: roles})
+}
+
+func LoadUser(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (*User, error) {
+	doc, err := getUserDoc(ctx, name, ahr)
+	if err != nil {
+		return nil, err
+	}
+	return userFromDoc(doc), nil
+}
+
+func ListUsers(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) ([]User, error) {
+	query := url.Values{"include_docs": {"true"}, "startkey": {`"` + userPrefix + `"`}, "endkey": {`"` + userPrefix + "\ufff0" + `"`}}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5984/_users/_all_docs?%s", ahr.Server(), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(docs.Rows))
+	for _, row := range docs.Rows {
+		users = append(users, *userFromDoc(row.Doc))
+	}
+	return users, nil
+}
+
+func SetUserPassword(ctx context.Context, name, password string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if password == "" {
+		return fmt.Errorf("Password is required!")
+	}
+
+	ctx, release, err := acquireLock(ctx, "set_user_password", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	doc, err := getUserDoc(ctx, name, ahr)
+	if err != nil {
+		return err
+	}
+	doc["password"] = password
+	if err = putUserDoc(ctx, name, doc, ahr); err != nil {
+		return err
+	}
+	// The password is never journaled.
+	return record(ctx, "set_user_password", name, nil, nil)
+}
+
+func SetUserRoles(ctx context.Context, name string, roles []string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if roles == nil {
+		roles = []string{}
+	}
+
+	ctx, release, err := acquireLock(ctx, "set_user_roles", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	doc, err := getUserDoc(ctx, name, ahr)
+	if err != nil {
+		return err
+	}
+	before := userFromDoc(doc)
+	doc["roles"] = roles
+	if err = putUserDoc(ctx, name, doc, ahr); err != nil {
+		return err
+	}
+	return record(ctx, "set_user_roles", name, before, User{Name: name, Roles: roles})
+}
+
+func DeleteUser(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "delete_user", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	doc, err := getUserDoc(ctx, name, ahr)
+	if err != nil {
+		return err
+	}
+	rev, _ := doc["_rev"].(string)
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s?rev=%s", userDocUrl(name, ahr), url.QueryEscape(rev)), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "delete_user", name, userFromDoc(doc), nil)
+}
+
+// getUserDoc reads the whole user document so that updating it keeps the
+// password hash and any other field.
+func getUserDoc(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", userDocUrl(name, ahr), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err = ahr.RunRequest(ctx, req, &doc); err != nil {
+		if httpUtils.IsStatus(err, http.StatusNotFound) {
+			return nil, fmt.Errorf("User %s does not exist!", name)
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+func putUserDoc(ctx context.Context, name string, doc map[string]interface{}, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", userDocUrl(name, ahr), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+func userFromDoc(doc map[string]interface{}) *User {
+	user := &User{Roles: []string{}}
+	user.Name, _ = doc["name"].(string)
+	if user.Name == "" {
+		id, _ := doc["_id"].(string)
+		user.Name = strings.TrimPrefix(id, userPrefix)
+	}
+	roles, _ := doc["roles"].([]interface{})
+	for _, role := range roles {
+		if r, ok := role.(string); ok {
+			user.Roles = append(user.Roles, r)
+		}
+	}
+	return user
+}
+
+// Admins returns the server admins configured on every node that is up and
+// joined, by node.
+func (cluster *Cluster) Admins(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (map[string][]string, error) {
+	admins := make(map[string][]string)
+	for _, node := range cluster.NodesInfo.ClusterNodes {
+		if !cluster.IsNodeUpAndJoined(node) {
+			continue
+		}
+
+		req, err := httpUtils.NewNodeRequest("GET", fmt.Sprintf("http://%s:5984/_node/%s/_config/admins", ahr.NodeHost(node), node), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var hashes map[string]string
+		if err = ahr.RunRequest(ctx, req, &hashes); err != nil {
+			return nil, fmt.Errorf("Could not read admins of %s: %s", node, err)
+		}
+		names := make([]string, 0, len(hashes))
+		for name := range hashes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		admins[node] = names
+	}
+	return admins, nil
+}
+
+// SetAdmin creates or updates a server admin on every node of the cluster.
+// It refuses to do so if any node is down so that no node is left behind.
+// The password is hashed by the first node only and its hash copied to the
+// others, as every node would otherwise salt it differently and cookies
+// issued by one node would not be accepted by the rest. If any node fails,
+// the nodes already changed are rolled back.
+func (cluster *Cluster) SetAdmin(ctx context.Context, name, password string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	if name == "" || password == "" {
+		return fmt.Errorf("Admin name and password are required!")
+	}
+
+	ctx, release, err := acquireLock(ctx, "set_admin", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err = cluster.requireAllNodesUp(); err != nil {
+		return err
+	}
+
+	nodes := cluster.NodesInfo.ClusterNodes
+	previous, err := adminHashes(ctx, name, nodes, ahr)
+	if err != nil {
+		return err
+	}
+
+	var hash string
+	for i, node := range nodes {
+		log.WithFields(log.Fields{"node": node, "admin": name}).Debug("Setting admin...")
+		value := hash
+		if i == 0 {
+			value = password
+		}
+		if err = putAdmin(ctx, node, name, value, ahr); err != nil {
+			err = fmt.Errorf("Could not set admin %s on %s: %s", name, node, err)
+			return rollbackAdmin(ctx, name, nodes[:i], previous, err, ahr)
+		}
+		if i > 0 {
+			continue
+		}
+
+		var exists bool
+		hash, exists, err = getAdminHash(ctx, node, name, ahr)
+		if err == nil && !strings.HasPrefix(hash, "-pbkdf2-") {
+			err = fmt.Errorf("%s is not hashed", name)
+		}
+		if err == nil && !exists {
+			err = fmt.Errorf("%s does not exist", name)
+		}
+		if err != nil {
+			err = fmt.Errorf("Could not read back admin %s's hash on %s: %s", name, node, err)
+			return rollbackAdmin(ctx, name, nodes[:1], previous, err, ahr)
+		}
+	}
+	// The password is never journaled.
+	return record(ctx, "set_admin", name, nil, nil)
+}
+
+// DeleteAdmin removes a server admin from every node of the cluster. If any
+// node fails, the admin is restored on the nodes already changed.
+func (cluster *Cluster) DeleteAdmin(ctx context.Context, name string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "delete_admin", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err = cluster.requireAllNodesUp(); err != nil {
+		return err
+	}
+
+	nodes := cluster.NodesInfo.ClusterNodes
+	previous, err := adminHashes(ctx, name, nodes, ahr)
+	if err != nil {
+		return err
+	}
+
+	for i, node := range nodes {
+		log.WithFields(log.Fields{"node": node, "admin": name}).Debug("Deleting admin...")
+		if err = deleteAdmin(ctx, node, name, ahr); err != nil {
+			err = fmt.Errorf("Could not delete admin %s on %s: %s", name, node, err)
+			return rollbackAdmin(ctx, name, nodes[:i], previous, err, ahr)
+		}
+	}
+	return record(ctx, "delete_admin", name, nil, nil)
+}
+
+func (cluster *Cluster) requireAllNodesUp() error {
+	for _, node := range cluster.NodesInfo.ClusterNodes {
+		if !cluster.IsNodeUpAndJoined(node) {
+			return fmt.Errorf("%s is down, refusing to change admins on part of the cluster!", node)
+		}
+	}
+	return nil
+}
+
+// adminHashes returns the admin's stored password hash on each of the nodes
+// where it exists.
+func adminHashes(ctx context.Context, name string, nodes []string, ahr *httpUtils.AuthenticatedHttpRequester) (map[string]string, error) {
+	hashes := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		hash, exists, err := getAdminHash(ctx, node, name, ahr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read admin %s on %s: %s", name, node, err)
+		}
+		if exists {
+			hashes[node] = hash
+		}
+	}
+	return hashes, nil
+}
+
+// rollbackAdmin restores the admin's previous hash on the given nodes, or
+// deletes it where it did not exist, and returns cause.
+func rollbackAdmin(ctx context.Context, name string, nodes []string, previous map[string]string, cause error, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	for _, node := range nodes {
+		log.WithFields(log.Fields{"node": node, "admin": name}).Warn("Rolling back admin...")
+		var err error
+		if hash, existed := previous[node]; existed {
+			err = putAdmin(ctx, node, name, hash, ahr)
+		} else {
+			err = deleteAdmin(ctx, node, name, ahr)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"node": node, "admin": name}).WithError(err).Error("Couldn't roll back admin!")
+		}
+	}
+	return cause
+}
+
+func adminUrl(node, name string, ahr *httpUtils.AuthenticatedHttpRequester) string {
+	return fmt.Sprintf("http://%s:5984/_node/%s/_config/admins/%s", ahr.NodeHost(node), node, url.PathEscape(name))
+}
+
+// getAdminHash returns the admin's stored password hash on node and whether
+// it exists.
+func getAdminHash(ctx context.Context, node, name string, ahr *httpUtils.AuthenticatedHttpRequester) (string, bool, error) {
+	req, err := httpUtils.NewNodeRequest("GET", adminUrl(node, name, ahr), nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	var hash string
+	if err = ahr.RunRequest(ctx, req, &hash); err != nil {
+		if httpUtils.IsStatus(err, http.StatusNotFound) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+// putAdmin sets the admin's password on node. Values already hashed are
+// stored as they are.
+func putAdmin(ctx context.Context, node, name, value string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	req, err := httpUtils.NewNodeRequest("PUT", adminUrl(node, name, ahr), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return ahr.RunRequest(ctx, req, nil)
+}
+
+func deleteAdmin(ctx context.Context, node, name string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	req, err := httpUtils.NewNodeRequest("DELETE", adminUrl(node, name, ahr), nil)
+	if err != nil {
+		return err
+	}
+	if err = ahr.RunRequest(ctx, req, nil); err != nil && !httpUtils.IsStatus(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func TestSetUserRolesKeepsPasswordHash(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_users/org.couchdb.user:billing",
+		httpmock.NewStringResponder(200, `{
+	"_id": "org.couchdb.user:billing", "_rev": "1-abc", "name": "billing", "type": "user", "roles": ["reader"],
+	"password_scheme": "pbkdf2", "iterations": 10, "derived_key": "c1a0", "salt": "5a17"}`))
+
+	var doc map[string]interface{}
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_users/org.couchdb.user:billing",
+		func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			if err := json.Unmarshal(b, &doc); err != nil {
+				return nil, err
+			}
+			return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := SetUserRoles(context.Background(), "billing", []string{"reader", "writer"}, ahr); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, doc["_rev"], "1-abc")
+	assert.Equal(t, doc["derived_key"], "c1a0")
+	assert.Equal(t, doc["salt"], "5a17")
+	assert.Equal(t, doc["roles"], []interface{}{"reader", "writer"})
+	assert.NotContains(t, doc, "password")
+}
+
+func TestListUsersReadsUserDocuments(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", `http://127.0.0.1:5984/_users/_all_docs?endkey=%22org.couchdb.user%3A%EF%BF%B0%22&include_docs=true&startkey=%22org.couchdb.user%3A%22`,
+		httpmock.NewStringResponder(200, `{"rows": [
+			{"doc": {"_id": "org.couchdb.user:billing", "name": "billing", "roles": ["reader"]}},
+			{"doc": {"_id": "org.couchdb.user:reports", "name": "reports", "roles": []}}]}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	users, err := ListUsers(context.Background(), ahr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, users, []User{{Name: "billing", Roles: []string{"reader"}}, {Name: "reports", Roles: []string{}}})
+}
+
+func TestSetAdminCopiesTheFirstNodesHash(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	const hash = "-pbkdf2-9f5b9e8a,0a1b2c3d4e5f,10"
+	stored := map[string]string{}
+	var puts []string
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		host := host
+		adminUrl := "http://" + host + ":5984/_node/couchdb@" + host + "/_config/admins/ops"
+		httpmock.RegisterResponder("GET", adminUrl, func(req *http.Request) (*http.Response, error) {
+			value, exists := stored[host]
+			if !exists {
+				return httpmock.NewStringResponse(404, `{"error": "not_found", "reason": "unknown_config_value"}`), nil
+			}
+			b, _ := json.Marshal(value)
+			return httpmock.NewBytesResponse(200, b), nil
+		})
+		httpmock.RegisterResponder("PUT", adminUrl, func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			puts = append(puts, host+" "+string(b))
+			if string(b) == `"s3cr3t"` {
+				stored[host] = hash
+			} else {
+				var value string
+				json.Unmarshal(b, &value)
+				stored[host] = value
+			}
+			return httpmock.NewStringResponse(200, `""`), nil
+		})
+	}
+
+	cluster := &Cluster{NodesInfo: Nodes{
+		AllNodes:     []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+		ClusterNodes: []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+	}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	if err := cluster.SetAdmin(context.Background(), "ops", "s3cr3t", ahr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, puts, []string{`127.0.0.1 "s3cr3t"`, `127.0.0.2 "` + hash + `"`})
+	assert.Equal(t, stored["127.0.0.1"], stored["127.0.0.2"])
+}
+
+func TestSetAdminRollsBackOnFailure(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	const oldHash = "-pbkdf2-0000,1111,10"
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/admins/ops",
+		httpmock.NewStringResponder(200, `"`+oldHash+`"`))
+	httpmock.RegisterResponder("GET", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/admins/ops",
+		httpmock.NewStringResponder(404, `{"error": "not_found", "reason": "unknown_config_value"}`))
+
+	var restored string
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/admins/ops",
+		func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			restored = string(b)
+			return httpmock.NewStringResponse(200, `""`), nil
+		})
+	httpmock.RegisterResponder("PUT", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/admins/ops",
+		httpmock.NewStringResponder(500, `{"error": "unknown_error", "reason": "boom"}`))
+
+	cluster := &Cluster{NodesInfo: Nodes{
+		AllNodes:     []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+		ClusterNodes: []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+	}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	assert.Error(t, cluster.SetAdmin(context.Background(), "ops", "s3cr3t", ahr))
+	assert.Equal(t, restored, `"`+oldHash+`"`)
+}
+
+func TestDeleteAdminRestoresItOnFailure(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	const oldHash = "-pbkdf2-0000,1111,10"
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		httpmock.RegisterResponder("GET", "http://"+host+":5984/_node/couchdb@"+host+"/_config/admins/ops",
+			httpmock.NewStringResponder(200, `"`+oldHash+`"`))
+	}
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/admins/ops",
+		httpmock.NewStringResponder(200, `"`+oldHash+`"`))
+	httpmock.RegisterResponder("DELETE", "http://127.0.0.2:5984/_node/couchdb@127.0.0.2/_config/admins/ops",
+		httpmock.NewStringResponder(500, `{"error": "unknown_error", "reason": "boom"}`))
+
+	var restored string
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5984/_node/couchdb@127.0.0.1/_config/admins/ops",
+		func(req *http.Request) (*http.Response, error) {
+			b, _ := ioutil.ReadAll(req.Body)
+			restored = string(b)
+			return httpmock.NewStringResponse(200, `""`), nil
+		})
+
+	cluster := &Cluster{NodesInfo: Nodes{
+		AllNodes:     []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+		ClusterNodes: []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+	}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	assert.Error(t, cluster.DeleteAdmin(context.Background(), "ops", ahr))
+	assert.Equal(t, restored, `"`+oldHash+`"`)
+}
+
+func TestSetAdminRefusesWhenANodeIsDown(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	cluster := &Cluster{NodesInfo: Nodes{
+		AllNodes:     []string{"couchdb@127.0.0.1"},
+		ClusterNodes: []string{"couchdb@127.0.0.1", "couchdb@127.0.0.2"},
+	}}
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	assert.Error(t, cluster.SetAdmin(context.Background(), "ops", "s3cr3t", ahr))
+}
@@ -0,0 +1,183 @@
+package couchdb_admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cabify/couchdb-admin/httpUtils"
+)
+
+// NodeZones returns the zone of every node that has one, as set in its _nodes
+// document.
+func NodeZones(ctx context.Context, ahr *httpUtils.AuthenticatedHttpRequester) (map[string]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_nodes/_all_docs?include_docs=true", ahr.Server()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs struct {
+		Rows []struct {
+			Doc struct {
+				Id   string `json:"_id"`
+				Zone string `json:"zone"`
+			} `json:"doc"`
+		} `json:"rows"`
+	}
+	if err = ahr.RunRequest(ctx, req, &docs); err != nil {
+		return nil, err
+	}
+
+	zones := make(map[string]string)
+	for _, row := range docs.Rows {
+		if row.Doc.Zone != "" {
+			zones[row.Doc.Id] = row.Doc.Zone
+		}
+	}
+	return zones, nil
+}
+
+func (cluster *Cluster) SetNodeZone(ctx context.Context, node *Node, zone string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	ctx, release, err := acquireLock(ctx, "set_node_zone", ahr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !cluster.knowsNode(node.Addr()) {
+		return fmt.Errorf("%s is not part of the cluster!", node.Addr())
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:5986/_nodes/%s", ahr.Server(), node.Addr()), nil)
+	if err != nil {
+		return err
+	}
+
+	// The whole document is kept as is, CouchDB may store other attributes.
+	var doc map[string]interface{}
+	if err = ahr.RunRequest(ctx, req, &doc); err != nil {
+		return err
+	}
+	before, _ := doc["zone"].(string)
+
+	if zone == "" {
+		delete(doc, "zone")
+	} else {
+		doc["zone"] = zone
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequest("PUT", fmt.Sprintf("http://%s:5986/_nodes/%s", ahr.Server(), node.Addr()), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err = ahr.RunRequest(ctx, req, nil); err != nil {
+		return err
+	}
+	return record(ctx, "set_node_zone", node.Addr(), map[string]string{"zone": before}, map[string]string{"zone": zone})
+}
+
+// ParsePlacement parses a placement rule such as zoneA:2,zoneB:1 into the
+// number of replicas each zone holds.
+func ParsePlacement(placement string) (map[string]int, error) {
+	zones := make(map[string]int)
+	for _, rule := range strings.Split(placement, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid placement rule %s, expected <zone>:<replicas>!", rule)
+		}
+		replicas, err := strconv.Atoi(parts[1])
+		if err != nil || replicas < 1 {
+			return nil, fmt.Errorf("Invalid placement rule %s, expected <zone>:<replicas>!", rule)
+		}
+		if _, exists := zones[parts[0]]; exists {
+			return nil, fmt.Errorf("Zone %s appears more than once in placement %s!", parts[0], placement)
+		}
+		zones[parts[0]] = replicas
+	}
+	return zones, nil
+}
+
+func checkPlacement(ctx context.Context, placement map[string]int, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	zones, err := NodeZones(ctx, ahr)
+	if err != nil {
+		return err
+	}
+
+	nodesPerZone := make(map[string]int)
+	for _, zone := range zones {
+		nodesPerZone[zone]++
+	}
+	for zone, replicas := range placement {
+		if nodesPerZone[zone] < replicas {
+			return fmt.Errorf("Zone %s has %d nodes but placement requires %d replicas there!", zone, nodesPerZone[zone], replicas)
+		}
+	}
+	return nil
+}
+
+// checkZoneSpread looks for ranges whose copies would all be in the same zone
+// even though the cluster spans several, or whose spread is unknown as some
+// of their copies are on nodes without a zone. Depending on the replica policy
+// they are either refused or logged as warnings. Clusters without any zone
+// are only checked when zone spread is required.
+func (db *Database) checkZoneSpread(ctx context.Context, ranges map[string][]string, ahr *httpUtils.AuthenticatedHttpRequester) error {
+	zones, err := NodeZones(ctx, ahr)
+	if err != nil {
+		return err
+	}
+
+	distinct := make(map[string]bool)
+	for _, zone := range zones {
+		distinct[zone] = true
+	}
+	if len(distinct) == 0 && !replicaPolicy.RequireZoneSpread {
+		return nil
+	}
+
+	shards := make([]string, 0, len(ranges))
+	for shard := range ranges {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	for _, shard := range shards {
+		rangeZones := make(map[string]bool)
+		var zoneless []string
+		for _, node := range ranges[shard] {
+			if zone, ok := zones[node]; ok {
+				rangeZones[zone] = true
+			} else {
+				zoneless = append(zoneless, node)
+			}
+		}
+
+		if len(zoneless) > 0 {
+			if replicaPolicy.RequireZoneSpread {
+				return fmt.Errorf("Shard %s of %s would have copies on nodes without a zone (%s), its zone spread is unknown!", shard, db.name, strings.Join(zoneless, ", "))
+			}
+			log.WithFields(log.Fields{"db": db.name, "shard": shard, "nodes": zoneless}).Warn("Shard has copies on nodes without a zone, its zone spread is unknown!")
+			continue
+		}
+		if len(rangeZones) > 1 || len(distinct) < 2 {
+			continue
+		}
+
+		if replicaPolicy.RequireZoneSpread {
+			return fmt.Errorf("Every copy of shard %s of %s would be in the same zone!", shard, db.name)
+		}
+		log.WithFields(log.Fields{"db": db.name, "shard": shard}).Warn("Every copy of the shard is in the same zone!")
+	}
+	return nil
+}
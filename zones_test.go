@@ -0,0 +1,143 @@
+package couchdb_admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cabify/couchdb-admin/httpUtils"
+	"github.com/stretchr/testify/assert"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+)
+
+func mockZones(zones map[string]string) {
+	var rows []string
+	for node, zone := range zones {
+		rows = append(rows, fmt.Sprintf(`{"id": "%s", "doc": {"_id": "%s", "_rev": "1-a", "zone": "%s"}}`, node, node, zone))
+	}
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_nodes/_all_docs?include_docs=true",
+		httpmock.NewStringResponder(200, `{"rows": [`+strings.Join(rows, ",")+`]}`))
+}
+
+func TestRemoveReplicaRefusesToLeaveRangeInOneZone(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+	mockZones(map[string]string{"couchdb@127.0.0.1": "zoneA", "couchdb@127.0.0.2": "zoneA", "couchdb@127.0.0.3": "zoneB"})
+
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1, RequireZoneSpread: true})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": ["00000000-ffffffff"],
+				"couchdb@127.0.0.2": ["00000000-ffffffff"],
+				"couchdb@127.0.0.3": ["00000000-ffffffff"]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"]
+			}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.3", ahr)
+	assert.Error(t, err, "Remove replica should have been rejected as every remaining copy is in zoneA")
+}
+
+func TestRemoveReplicaRefusesUnknownZoneSpread(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+	mockZones(map[string]string{"couchdb@127.0.0.1": "zoneA", "couchdb@127.0.0.2": "zoneB"})
+
+	SetReplicaPolicy(ReplicaPolicy{MinReplicas: 1, RequireZoneSpread: true})
+	defer SetReplicaPolicy(DefaultReplicaPolicy)
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_dbs/testdb",
+		httpmock.NewStringResponder(200, `{
+			"_id": "testdb",
+			"_rev": "1-5e2d10c29c70d3869fb7a1fd3a827a64",
+			"shard_suffix": [ 46, 49, 52, 50, 53, 50, 48, 50, 53, 55, 55 ],
+			"changelog": [],
+			"by_node": {
+				"couchdb@127.0.0.1": ["00000000-ffffffff"],
+				"couchdb@127.0.0.2": ["00000000-ffffffff"],
+				"couchdb@127.0.0.3": ["00000000-ffffffff"]
+			},
+			"by_range": {
+				"00000000-ffffffff": ["couchdb@127.0.0.1", "couchdb@127.0.0.2", "couchdb@127.0.0.3"]
+			}}`))
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	db, err := LoadDB(context.Background(), "testdb", ahr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.RemoveReplica(context.Background(), "00000000-ffffffff", "127.0.0.2", ahr)
+	if assert.Error(t, err, "Remove replica should have been rejected as couchdb@127.0.0.3 has no zone") {
+		assert.Contains(t, err.Error(), "without a zone")
+	}
+}
+
+func TestSetNodeZoneKeepsOtherAttributes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	mockLocks()
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5984/_membership",
+		httpmock.NewStringResponder(200, `{
+	"all_nodes": ["couchdb@127.0.0.1"],
+	"cluster_nodes": ["couchdb@127.0.0.1"]}`))
+
+	httpmock.RegisterResponder("GET", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.1",
+		httpmock.NewStringResponder(200, `{"_id": "couchdb@127.0.0.1", "_rev": "1-a", "other": "value"}`))
+
+	httpmock.RegisterResponder("PUT", "http://127.0.0.1:5986/_nodes/couchdb@127.0.0.1",
+		func(req *http.Request) (*http.Response, error) {
+			var doc map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, doc, map[string]interface{}{"_id": "couchdb@127.0.0.1", "_rev": "1-a", "other": "value", "zone": "zoneA"})
+			return httpmock.NewStringResponse(201, `{"ok": true}`), nil
+		})
+
+	ahr := httpUtils.NewAuthenticatedHttpRequester("dummyuser", "dummypassword", "127.0.0.1")
+	cluster, err := LoadCluster(context.Background(), ahr)
+	if err != nil {
+		t.Error(err)
+	}
+	node, err := ParseNode("127.0.0.1")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = cluster.SetNodeZone(context.Background(), node, "zoneA", ahr); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParsePlacement(t *testing.T) {
+	placement, err := ParsePlacement("zoneA:2,zoneB:1")
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, placement, map[string]int{"zoneA": 2, "zoneB": 1})
+
+	for _, invalid := range []string{"", "zoneA", "zoneA:0", ":1", "zoneA:1,zoneA:2"} {
+		_, err = ParsePlacement(invalid)
+		assert.Error(t, err, invalid)
+	}
+}